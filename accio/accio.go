@@ -4,8 +4,41 @@
 //
 package accio
 
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Remote file, as listed
+type FileInfo struct {
+	Name    string // Full remote name, as for GetFile
+	Size    int64
+	ModTime time.Time // Last put
+}
+
 type Access interface {
 	Init() (string, error)
 	Name() string
+
+	// Gets remote file src to local dst. If src is not there, the error
+	// is one os.IsNotExist() is true for (see NotExist).
 	GetFile(src string, dst string) error
+
+	// Uploads local file src to remote dst, creating dirs as needed.
+	// dst is replaced atomically - readers see the old or the new file,
+	// never a partial one.
+	PutFile(src string, dst string) error
+
+	// Lists remote files below dir, recursively. dir is as returned by
+	// Init, "" for the top.
+	List(dir string) ([]FileInfo, error)
+
+	// Deletes remote file name. Its not an error if name is not there.
+	DeleteFile(name string) error
+}
+
+// Error for remote file src not there
+func NotExist(src string) error {
+	return &os.PathError{Op: "GetFile", Path: src, Err: syscall.ENOENT}
 }
@@ -6,9 +6,14 @@ package cp
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 
 	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux/accio"
 )
 
 type Data struct {
@@ -56,3 +61,79 @@ func (D Data) GetFile(src string, dst string) error {
 	_, err = io.Copy(outF, inF)
 	return err
 }
+
+func (D Data) PutFile(src string, dst string) error {
+	log.WithFields(
+		log.Fields{
+			"SRC": src,
+			"DST": dst,
+		}).Debug("Accio: CP - PutFile")
+
+	inF, err := os.Open(src)
+	if err != nil {
+		log.Errorf("Accio: cp: Cannot open src file %v, err %v", src, err)
+		return err
+	}
+	defer inF.Close()
+
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		log.Errorf("Accio: cp: Cannot create dst dir %v, err %v", path.Dir(dst), err)
+		return err
+	}
+
+	// Copy to tmp and rename - rename is atomic
+	outF, err := ioutil.TempFile(path.Dir(dst), path.Base(dst)+".")
+	if err != nil {
+		log.Errorf("Accio: cp: Cannot create tmp file for %v, err %v", dst, err)
+		return err
+	}
+	tmpName := outF.Name()
+
+	_, err = io.Copy(outF, inF)
+	if err == nil {
+		err = outF.Sync()
+	}
+	outF.Close()
+	if err == nil {
+		err = os.Chmod(tmpName, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, dst)
+	}
+	if err != nil {
+		log.Errorf("Accio: cp: Cannot put file %v, err %v", dst, err)
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+func (D Data) List(dir string) ([]accio.FileInfo, error) {
+	log.WithFields(log.Fields{"DIR": dir}).Debug("Accio: CP - List")
+
+	var files []accio.FileInfo
+	err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			files = append(files, accio.FileInfo{Name: name, Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Accio: cp: Cannot list dir %v, err %v", dir, err)
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (D Data) DeleteFile(name string) error {
+	log.WithFields(log.Fields{"NAME": name}).Debug("Accio: CP - DeleteFile")
+
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Accio: cp: Cannot delete file %v, err %v", name, err)
+		return err
+	}
+	return nil
+}
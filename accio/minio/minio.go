@@ -17,6 +17,8 @@ import (
 	"github.com/minio/minio-go"
 
 	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux/accio"
 )
 
 const (
@@ -105,6 +107,9 @@ func (D *Data) GetFile(src string, dst string) error {
 	reader, err := D.s3Client.GetObject(D.BktName, src)
 	if err != nil {
 		log.Errorf("MINIO: GetFile error %v", err)
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return accio.NotExist(src)
+		}
 		return err
 	}
 	
@@ -118,6 +123,9 @@ func (D *Data) GetFile(src string, dst string) error {
 	_, err = io.Copy(outF, reader)
 	if err != nil {
 		os.Remove(dst)
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return accio.NotExist(src)
+		}
 	}
 	return err
 }
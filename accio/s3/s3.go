@@ -9,11 +9,14 @@ import (
 	"syscall"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux/accio"
 )
 
 type Data struct {
@@ -89,6 +92,9 @@ func (D *Data) GetFile(src string, dst string) error {
 		log.WithFields(
 			log.Fields{"S3": D, "Key": src, "Error": err}).Error("S3: Cannot download")
 		os.Remove(dst)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchKey" {
+			return accio.NotExist(src)
+		}
 		return err
 	}
 
@@ -96,3 +102,81 @@ func (D *Data) GetFile(src string, dst string) error {
 		log.Fields{"S3": D, "Src": src, "Dst": dst, "Bytes recvd": n}).Debug("S3: GetFile")
 	return nil
 }
+
+// S3 objects are replaced atomically on put
+func (D *Data) PutFile(src string, dst string) error {
+	log.WithFields(
+		log.Fields{"src": src,
+			"dst":      dst,
+			"S3 Data": D,
+		}).Info("S3: PutFile")
+
+	file, err := os.Open(src)
+	if err != nil {
+		log.WithFields(log.Fields{"src": src}).Error("S3: Cannot open file")
+		return err
+	}
+	defer file.Close()
+
+	s3Param := &s3manager.UploadInput{
+		Bucket: aws.String(D.BktName),
+		Key:    aws.String(dst),
+		Body:   file}
+	uploader := s3manager.NewUploader(D.s3Sess)
+	_, err = uploader.Upload(s3Param)
+	if err != nil {
+		log.WithFields(
+			log.Fields{"S3": D, "Key": dst, "Error": err}).Error("S3: Cannot upload")
+		return err
+	}
+
+	log.WithFields(
+		log.Fields{"S3": D, "Src": src, "Dst": dst}).Debug("S3: PutFile")
+	return nil
+}
+
+func (D *Data) List(dir string) ([]accio.FileInfo, error) {
+	log.WithFields(log.Fields{"dir": dir, "S3 Data": D}).Info("S3: List")
+
+	prefix := dir
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var files []accio.FileInfo
+	s3Param := &s3.ListObjectsInput{
+		Bucket: aws.String(D.BktName),
+		Prefix: aws.String(prefix)}
+	err := s3.New(D.s3Sess).ListObjectsPages(s3Param, func(page *s3.ListObjectsOutput, last bool) bool {
+		for _, obj := range page.Contents {
+			files = append(files, accio.FileInfo{
+				Name:    aws.StringValue(obj.Key),
+				Size:    aws.Int64Value(obj.Size),
+				ModTime: aws.TimeValue(obj.LastModified)})
+		}
+		return true
+	})
+	if err != nil {
+		log.WithFields(
+			log.Fields{"S3": D, "Prefix": prefix, "Error": err}).Error("S3: Cannot list")
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// Deleting a key not there is not an error in S3
+func (D *Data) DeleteFile(name string) error {
+	log.WithFields(log.Fields{"name": name, "S3 Data": D}).Info("S3: DeleteFile")
+
+	s3Param := &s3.DeleteObjectInput{
+		Bucket: aws.String(D.BktName),
+		Key:    aws.String(name)}
+	if _, err := s3.New(D.s3Sess).DeleteObject(s3Param); err != nil {
+		log.WithFields(
+			log.Fields{"S3": D, "Key": name, "Error": err}).Error("S3: Cannot delete")
+		return err
+	}
+
+	return nil
+}
@@ -14,12 +14,19 @@ import (
 	"fmt"
     "net"
 	"golang.org/x/crypto/ssh"
+	"io/ioutil"
 	"os"
 	"os/user"
+	"path"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux/accio"
 )
 
 type Data struct {
@@ -36,6 +43,7 @@ type Data struct {
 
 const RSA_PRIVATEKEY_FILE = ".ssh/id_rsa"
 const SCP_COMMAND = "/usr/bin/scp -vf "
+const SCP_PUT_COMMAND = "/usr/bin/scp -qt "
 
 func (D *Data) String() string {
 	return "SCP::" + "User:" + D.User + ",Host:" + D.Host + ",RemotePath:" + D.RemotePath
@@ -199,6 +207,10 @@ func (D *Data) GetFile(src string, dst string) error {
 			"Error": err,
 		}).Error("SCP: Cannot run scp command")
 
+		// scp sends errors in its response
+		if strings.Contains(stdout.String(), "No such file or directory") {
+			return accio.NotExist(src)
+		}
 		return err
 	}
 
@@ -217,3 +229,154 @@ func (D *Data) GetFile(src string, dst string) error {
 	return nil
 
 }
+
+// Runs cmd on remote host
+func (D *Data) run(cmd string) error {
+	_, err := D.output(cmd)
+	return err
+}
+
+// Runs cmd on remote host, returns its output
+func (D *Data) output(cmd string) (string, error) {
+	var stderr bytes.Buffer
+	var stdout bytes.Buffer
+
+	sess, err := D.client.NewSession()
+	if err != nil {
+		log.WithFields(
+			log.Fields{"SCP Data": D, "Err": err}).Error("SCP: Cannot create new session")
+		return "", err
+	}
+	defer sess.Close()
+
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	if err := sess.Run(cmd); err != nil {
+		log.WithFields(log.Fields{
+			"CMD":    cmd,
+			"Stderr": stderr.String(),
+			"Error":  err,
+		}).Error("SCP: Cannot run command")
+		return "", err
+	}
+
+	return stdout.String(), nil
+}
+
+// Quotes s for the remote shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Tmp files of puts in this process
+var putSeq uint64
+
+// Copies to a tmp file next to dst and moves it - mv is atomic
+func (D *Data) PutFile(src string, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		log.WithFields(
+			log.Fields{"SRC": src, "Err": err}).Error("SCP: Cannot read local file")
+		return err
+	}
+
+	if err := D.run("mkdir -p " + shellQuote(path.Dir(dst))); err != nil {
+		return err
+	}
+
+	// Puts of the same dst at once don't share it
+	seq := atomic.AddUint64(&putSeq, 1)
+	tmp := dst + "." + strconv.Itoa(os.Getpid()) + "." + strconv.FormatUint(seq, 10) + ".tmp"
+
+	sess, err := D.client.NewSession()
+	if err != nil {
+		log.WithFields(
+			log.Fields{"SCP Data": D, "Err": err}).Error("SCP: Cannot create new session")
+		return err
+	}
+	defer sess.Close()
+
+	wrPipe, err := sess.StdinPipe()
+	if err != nil {
+		log.WithFields(
+			log.Fields{"SCP Data": D, "Err": err}).Error("SCP: Cannot get stdin")
+		return err
+	}
+
+	wrErr := make(chan error, 1)
+	go func() {
+		defer wrPipe.Close()
+
+		if _, err := fmt.Fprintf(wrPipe, "C0644 %d %s\n", len(data), path.Base(tmp)); err != nil {
+			wrErr <- err
+			return
+		}
+		if _, err := wrPipe.Write(data); err != nil {
+			wrErr <- err
+			return
+		}
+		_, err := fmt.Fprintf(wrPipe, "\x00")
+		wrErr <- err
+	}()
+
+	cmd := SCP_PUT_COMMAND + shellQuote(tmp)
+	err = sess.Run(cmd)
+	if werr := <-wrErr; err == nil && werr != nil {
+		err = werr
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"CMD":   cmd,
+			"Error": err,
+		}).Error("SCP: Cannot run scp command")
+		D.run("rm -f " + shellQuote(tmp))
+		return err
+	}
+
+	if err := D.run("mv -f " + shellQuote(tmp) + " " + shellQuote(dst)); err != nil {
+		D.run("rm -f " + shellQuote(tmp))
+		return err
+	}
+
+	return nil
+}
+
+// Lists with find - "<mtime> <size> <name>" per file
+func (D *Data) List(dir string) ([]accio.FileInfo, error) {
+	// Top is the login dir, as for find with no dir
+	if dir == "" {
+		dir = "."
+	}
+
+	out, err := D.output("find " + shellQuote(dir) + " -type f -printf '%T@ %s %p\\n'")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []accio.FileInfo
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		mtime, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			log.WithFields(log.Fields{"Line": line}).Error("SCP: Invalid list output")
+			return nil, syscall.EINVAL
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			log.WithFields(log.Fields{"Line": line}).Error("SCP: Invalid list output")
+			return nil, syscall.EINVAL
+		}
+
+		files = append(files, accio.FileInfo{Name: fields[2], Size: size, ModTime: time.Unix(int64(mtime), 0)})
+	}
+
+	return files, nil
+}
+
+func (D *Data) DeleteFile(name string) error {
+	return D.run("rm -f " + shellQuote(name))
+}
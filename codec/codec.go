@@ -0,0 +1,402 @@
+// Codec - encodes chunks before they are stored remote and decodes
+// them when they are brought back to the local cache
+//   - Compression: none, gzip, zstd (horcrux.CODEC_*)
+//   - Encryption: aes-256-gcm (horcrux.ENCRYPT_*), of chunks and meta
+//   - Chunk hashes are always of the decoded data, so the same data
+//     dedups the same way with any codec. With encryption the hash is
+//     keyed (HMAC), so chunk names don't tell anything about the data.
+//   - The key is not used as is - chunk encryption, chunk names, meta
+//     encryption and the key id each use their own subkey of it (HKDF-SHA256)
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/hkdf"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+)
+
+const (
+	KEY_ENV  = "HORCRUX_KEY" // Hex encoded key, if no key file is given
+	KEY_SIZE = 32            // AES-256
+
+	// HKDF info of the subkeys
+	KEY_CHUNK_ENC  = "horcrux chunk enc"
+	KEY_CHUNK_NAME = "horcrux chunk name"
+	KEY_META_ENC   = "horcrux meta enc"
+	KEY_ID         = "horcrux key id"
+
+	// Encrypted meta file starts with this
+	META_MAGIC = "HORCRUX-" + horcrux.ENCRYPT_AESGCM + "\n"
+)
+
+var (
+	ErrNoKey        = errors.New("horcrux is encrypted, no key given")
+	ErrBadKey       = errors.New("wrong key or corrupted data, cannot decrypt")
+	ErrNotEncrypted = errors.New("key given, but horcrux meta is not encrypted")
+)
+
+type Codec struct {
+	compress string
+	nameKey  []byte // Keys chunk hashes
+	aead     cipher.AEAD
+}
+
+// New codec for horcrux with cfg - key is needed if cfg is encrypted
+func New(cfg horcrux.Config, key []byte) (*Codec, error) {
+	if !Valid(cfg.Codec) {
+		log.Errorf("Codec: unknown codec %v", cfg.Codec)
+		return nil, syscall.EINVAL
+	}
+
+	c := &Codec{compress: cfg.Codec}
+	if cfg.Encryption == "" {
+		return c, nil
+	}
+
+	if cfg.Encryption != horcrux.ENCRYPT_AESGCM {
+		log.Errorf("Codec: unknown encryption %v", cfg.Encryption)
+		return nil, syscall.EINVAL
+	}
+
+	if len(key) == 0 {
+		log.Error("Codec: horcrux is encrypted, but no key given")
+		return nil, ErrNoKey
+	}
+
+	if cfg.KeyId != KeyId(key) {
+		log.WithFields(log.Fields{"Key Id": cfg.KeyId, "Given Key Id": KeyId(key)}).Error("Codec: wrong key")
+		return nil, ErrBadKey
+	}
+
+	encKey, err := subKey(key, KEY_CHUNK_ENC)
+	if err != nil {
+		return nil, err
+	}
+
+	nameKey, err := subKey(key, KEY_CHUNK_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c.nameKey = nameKey
+	c.aead = aead
+	return c, nil
+}
+
+// Is codec name known
+func Valid(codec string) bool {
+	switch codec {
+	case "", horcrux.CODEC_NONE, horcrux.CODEC_GZIP, horcrux.CODEC_ZSTD:
+		return true
+	}
+	return false
+}
+
+// Does the codec change the data at all
+func (c *Codec) Passthrough() bool {
+	return c.aead == nil && (c.compress == "" || c.compress == horcrux.CODEC_NONE)
+}
+
+// Hash of chunk data - its name in the chunk store
+func (c *Codec) Hash(data []byte) string {
+	if c.nameKey == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	mac := hmac.New(sha256.New, c.nameKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Encodes chunk data with hash - compress and then encrypt
+func (c *Codec) Encode(hash string, data []byte) ([]byte, error) {
+	data, err := compress(c.compress, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.aead == nil {
+		return data, nil
+	}
+
+	// Hash is authenticated too - a chunk cannot be swapped for another
+	return seal(c.aead, data, []byte(hash))
+}
+
+// Decodes chunk data with hash - decrypt and then decompress
+func (c *Codec) Decode(hash string, data []byte) ([]byte, error) {
+	var err error
+
+	if c.aead != nil {
+		data, err = open(c.aead, data, []byte(hash))
+		if err != nil {
+			log.WithFields(log.Fields{"Hash": hash, "Error": err}).Error("Codec: Cannot decrypt chunk")
+			return nil, err
+		}
+	}
+
+	return decompress(c.compress, data)
+}
+
+// Key id to check the key with, without giving the key away
+func KeyId(key []byte) string {
+	idKey, err := subKey(key, KEY_ID)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(idKey)[:16]
+}
+
+// Subkey of key for info (KEY_CHUNK_ENC, ...), so one use of the key
+// does not give away anything about another
+func subKey(key []byte, info string) ([]byte, error) {
+	sub := make([]byte, KEY_SIZE)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(info)), sub); err != nil {
+		log.Errorf("Codec: Cannot derive subkey %v, err %v", info, err)
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Gets the key from keyFile, or from KEY_ENV if keyFile is not given
+// Key is hex encoded KEY_SIZE bytes (ex: openssl rand -hex 32)
+// Returns nil key if there is none
+func LoadKey(keyFile string) ([]byte, error) {
+	var keyHex string
+
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			log.Errorf("Codec: Cannot read key file %v, err %v", keyFile, err)
+			return nil, err
+		}
+		keyHex = string(data)
+	} else {
+		keyHex = os.Getenv(KEY_ENV)
+	}
+
+	keyHex = strings.TrimSpace(keyHex)
+	if keyHex == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(keyHex)
+	if err != nil || len(key) != KEY_SIZE {
+		log.Errorf("Codec: Key has to be %v bytes hex encoded", KEY_SIZE)
+		return nil, syscall.EINVAL
+	}
+
+	return key, nil
+}
+
+// Encrypts meta data with key
+func SealMeta(key []byte, data []byte) ([]byte, error) {
+	aead, err := metaAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := seal(aead, data, []byte(META_MAGIC))
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(META_MAGIC), enc...), nil
+}
+
+// Checks if meta data is sealed with SealMeta
+func IsSealedMeta(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(META_MAGIC))
+}
+
+// Decrypts meta data, if its encrypted
+//  - With a key, meta data has to be encrypted with it
+func OpenMeta(key []byte, data []byte) ([]byte, error) {
+	if !IsSealedMeta(data) {
+		if len(key) != 0 {
+			log.Error("Codec: key given, but meta is not encrypted")
+			return nil, ErrNotEncrypted
+		}
+		return data, nil
+	}
+
+	if len(key) == 0 {
+		log.Error("Codec: meta is encrypted, but no key given")
+		return nil, ErrNoKey
+	}
+
+	aead, err := metaAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := open(aead, data[len(META_MAGIC):], []byte(META_MAGIC))
+	if err != nil {
+		log.Error("Codec: Cannot decrypt meta")
+		return nil, err
+	}
+
+	return dec, nil
+}
+
+//
+// Encryption
+//
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Errorf("Codec: Cannot create cipher, err %v", err)
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func metaAEAD(key []byte) (cipher.AEAD, error) {
+	metaKey, err := subKey(key, KEY_META_ENC)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(metaKey)
+}
+
+// Returns nonce + sealed data
+func seal(aead cipher.AEAD, data []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		log.Errorf("Codec: Cannot get nonce, err %v", err)
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, ad), nil
+}
+
+func open(aead cipher.AEAD, data []byte, ad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, ErrBadKey
+	}
+
+	nonce := data[:aead.NonceSize()]
+	dec, err := aead.Open(nil, nonce, data[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrBadKey
+	}
+
+	return dec, nil
+}
+
+//
+// Compression
+//
+
+// zstd encoder/decoder are heavy - create once, they are safe for concurrent *All() calls
+var zstdOnce sync.Once
+var zstdEnc *zstd.Encoder
+var zstdDec *zstd.Decoder
+var zstdErr error
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEnc, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDec, zstdErr = zstd.NewReader(nil)
+	})
+
+	if zstdErr != nil {
+		log.Errorf("Codec: Cannot init zstd, err %v", zstdErr)
+	}
+	return zstdErr
+}
+
+func compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", horcrux.CODEC_NONE:
+		return data, nil
+
+	case horcrux.CODEC_GZIP:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			log.Errorf("Codec: gzip write failed, err %v", err)
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			log.Errorf("Codec: gzip close failed, err %v", err)
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case horcrux.CODEC_ZSTD:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEnc.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	}
+
+	log.Errorf("Codec: compress - unknown codec %v", codec)
+	return nil, syscall.EINVAL
+}
+
+func decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", horcrux.CODEC_NONE:
+		return data, nil
+
+	case horcrux.CODEC_GZIP:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			log.Errorf("Codec: gzip reader failed, err %v", err)
+			return nil, err
+		}
+		defer gz.Close()
+
+		out, err := ioutil.ReadAll(gz)
+		if err != nil {
+			log.Errorf("Codec: gzip read failed, err %v", err)
+			return nil, err
+		}
+		return out, nil
+
+	case horcrux.CODEC_ZSTD:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		out, err := zstdDec.DecodeAll(data, nil)
+		if err != nil {
+			log.Errorf("Codec: zstd decode failed, err %v", err)
+			return nil, err
+		}
+		return out, nil
+	}
+
+	log.Errorf("Codec: decompress - unknown codec %v", codec)
+	return nil, syscall.EINVAL
+}
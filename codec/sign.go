@@ -0,0 +1,198 @@
+//
+// Signing of metas - tells a version was made by a trusted key holder
+//  - ed25519, of the meta JSON without its signature (horcrux.Signature)
+//  - Signature is checked on the meta as read, so the reader has to know
+//    all its fields - same or newer horcrux as the signer
+//  - Sign key is hex encoded ed25519 seed (32 bytes) or private key (64 bytes)
+//  - Trusted keys file has hex encoded public keys, one per line.
+//    Lines starting with # are comments.
+//
+
+package codec
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+)
+
+const (
+	SIGNKEY_ENV = "HORCRUX_SIGNKEY"      // Hex encoded sign key, if no sign key file is given
+	TRUSTED_ENV = "HORCRUX_TRUSTED_KEYS" // Trusted keys file, if none is given
+
+	// Signed data starts with this
+	SIGN_MAGIC = "HORCRUX-META-SIGNATURE\n"
+)
+
+var (
+	ErrUnsigned     = errors.New("meta is not signed")
+	ErrBadSignature = errors.New("meta signature is not valid")
+	ErrUntrusted    = errors.New("meta is signed by a key not trusted")
+)
+
+// New sign key, and its public key
+func NewSignKey() (ed25519.PrivateKey, ed25519.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Errorf("Codec: Cannot generate sign key, err %v", err)
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+// Hex encoded public key of sign key priv
+func PublicKey(priv ed25519.PrivateKey) string {
+	return hex.EncodeToString(priv.Public().(ed25519.PublicKey))
+}
+
+// Gets the sign key from keyFile, or from SIGNKEY_ENV if keyFile is not given
+// Returns nil key if there is none
+func LoadSignKey(keyFile string) (ed25519.PrivateKey, error) {
+	var keyHex string
+
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			log.Errorf("Codec: Cannot read sign key file %v, err %v", keyFile, err)
+			return nil, err
+		}
+		keyHex = string(data)
+	} else {
+		keyHex = os.Getenv(SIGNKEY_ENV)
+	}
+
+	keyHex = strings.TrimSpace(keyHex)
+	if keyHex == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		log.Errorf("Codec: Sign key has to be hex encoded")
+		return nil, syscall.EINVAL
+	}
+
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+
+	log.Errorf("Codec: Sign key has to be %v or %v bytes", ed25519.SeedSize, ed25519.PrivateKeySize)
+	return nil, syscall.EINVAL
+}
+
+// Gets trusted public keys from keysFile, or from the file in TRUSTED_ENV
+// if keysFile is not given. Returns no keys if there is no file.
+func LoadTrustedKeys(keysFile string) ([]ed25519.PublicKey, error) {
+	if keysFile == "" {
+		keysFile = os.Getenv(TRUSTED_ENV)
+		if keysFile == "" {
+			return nil, nil
+		}
+	}
+
+	f, err := os.Open(keysFile)
+	if err != nil {
+		log.Errorf("Codec: Cannot open trusted keys file %v, err %v", keysFile, err)
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []ed25519.PublicKey
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, err := hex.DecodeString(text)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			log.Errorf("Codec: Invalid key in trusted keys file %v, line %v", keysFile, line)
+			return nil, syscall.EINVAL
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Codec: Cannot read trusted keys file %v, err %v", keysFile, err)
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Signs Meta with priv
+func SignMeta(priv ed25519.PrivateKey, Meta *horcrux.Meta) error {
+	data, err := signedData(Meta)
+	if err != nil {
+		return err
+	}
+
+	Meta.Signature = &horcrux.Signature{
+		Key: PublicKey(priv),
+		Sig: hex.EncodeToString(ed25519.Sign(priv, data)),
+	}
+	return nil
+}
+
+// Checks Meta is signed by one of trusted
+func VerifyMeta(Meta *horcrux.Meta, trusted []ed25519.PublicKey) error {
+	if Meta.Signature == nil {
+		return ErrUnsigned
+	}
+
+	key, err := hex.DecodeString(Meta.Signature.Key)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return ErrBadSignature
+	}
+
+	sig, err := hex.DecodeString(Meta.Signature.Sig)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return ErrBadSignature
+	}
+
+	data, err := signedData(Meta)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(key), data, sig) {
+		return ErrBadSignature
+	}
+
+	for _, k := range trusted {
+		if k.Equal(ed25519.PublicKey(key)) {
+			return nil
+		}
+	}
+
+	return ErrUntrusted
+}
+
+// Meta JSON without its signature
+func signedData(Meta *horcrux.Meta) ([]byte, error) {
+	unsigned := *Meta
+	unsigned.Signature = nil
+
+	js, err := json.Marshal(&unsigned)
+	if err != nil {
+		log.WithFields(log.Fields{"Version": Meta.CurrVer, "Error": err}).Error("Codec: Cannot marshal meta to sign")
+		return nil, err
+	}
+
+	return append([]byte(SIGN_MAGIC), js...), nil
+}
@@ -4,7 +4,14 @@
 package horcrux
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -13,28 +20,81 @@ const LOGLEVEL = log.InfoLevel
 
 const (
 	VERMAJOR = "00"
-	VERMINOR = "10"
+	VERMINOR = "11"
 	VEREXTRA = ""
 	VERSION  = VERMAJOR + "." + VERMINOR + VEREXTRA
 
+	// Versions are only numbered up - old ones are pruned, not reused.
+	// MAXVER only keeps the number in an int32.
 	MINVER   = 1
-	MAXVER   = 1000
+	MAXVER   = 1<<31 - 1
 	STARTVER = MINVER
 
 	CHUNKSIZE_MIN         = (1 << 20) // 1M
 	CHUNKSIZE_DEFAULT     = (64 << 20) // 64M
 	CHUNKSIZE_DEFAULT_STR = "64M"
+
+	// Rollsum chunks are bounded to [avg/ROLLSUM_MIN_DIV, avg*ROLLSUM_MAX_MUL]
+	ROLLSUM_MIN_DIV = 4
+	ROLLSUM_MAX_MUL = 4
+	ROLLSUM_WINDOW  = 64 // Bytes in the rolling checksum window
 )
 
+// Inode of the root dir - others are numbered up from it
+const ROOTINO = 1
+
+// Chunks are stored by the sha256 of their content, under
+// CHUNKDIR/<first 2 hex digits>/<hash> - shared by all files and versions
+const CHUNKDIR = "chunks"
+
+func ChunkPath(hash string) string {
+	return CHUNKDIR + "/" + hash[:2] + "/" + hash
+}
+
+// Each version has its meta in <version>/<name>.meta, <name>.meta at the
+// top is the latest version. Versions share chunks, so a version only
+// adds the chunks that are new in it.
+func VerMetaPath(ver string, name string) string {
+	return ver + "/" + name + ".meta"
+}
+
+// Version name for version number (v1, v2, ...)
+func VerName(ver int) string {
+	return "v" + strconv.Itoa(ver)
+}
+
+// Version number from version name
+func VerNum(ver string) (int, error) {
+	if !strings.HasPrefix(ver, "v") {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.Atoi(ver[1:])
+}
+
 const (
 	CHUNK_TYPE_STATIC = 1 + iota
 	CHUNK_TYPE_ROLLSUM
 )
 
+// Chunk compression (codec package)
+const (
+	CODEC_NONE = "none"
+	CODEC_GZIP = "gzip"
+	CODEC_ZSTD = "zstd"
+)
+
+// Chunk and meta encryption (codec package)
+const ENCRYPT_AESGCM = "aes-256-gcm"
+
 type Config struct {
-	Version   string `json:"Version"`
-	ChunkType int    `json:"Chunk Type"`
-	ChunkSize int    `json:"Chunk Size"`
+	Version      string `json:"Version"`
+	ChunkType    int    `json:"Chunk Type"`
+	ChunkSize    int    `json:"Chunk Size"` // Fixed size for static, average for rollsum
+	MinChunkSize int    `json:"Min Chunk Size,omitempty"`
+	MaxChunkSize int    `json:"Max Chunk Size,omitempty"`
+	Codec        string `json:"Codec,omitempty"`      // Chunk compression, none if empty
+	Encryption   string `json:"Encryption,omitempty"` // Chunk and meta encryption, none if empty
+	KeyId        string `json:"Key Id,omitempty"`     // To check the key, see codec.KeyId
 }
 
 type Stat struct {
@@ -42,20 +102,291 @@ type Stat struct {
 	Size int64       `json:"Size"`
 	Uid  uint32      `json:"Uid"` //XXX Get from running pid?
 	Gid  uint32      `json:"Gid"` //XXX Get from running pid?
-	/* TODO: Do we need {A,M,C}tim */
+
+	// Unix nsecs - mtime also to find files changed since the last version
+	Atime int64 `json:"Atime,omitempty"`
+	Mtime int64 `json:"Mtime,omitempty"`
+	Ctime int64 `json:"Ctime,omitempty"`
 }
 
 type Entry struct {
-	Name      string `json:"Name"`
-	Prefix    string `json:"Prefix"`
-	IsDir     bool   `json:"IsDir"`
-	Stat      Stat   `json:"Stat"`
-	NumChunks int64  `json:"Number of Chunks"`
+	Name      string   `json:"Name"`
+	Prefix    string   `json:"Prefix"`
+	IsDir     bool     `json:"IsDir"`
+	Stat      Stat     `json:"Stat"`
+	Ino       uint64   `json:"Inode,omitempty"` // Same across versions and renames, see SetInodes
+	NumChunks int64    `json:"Number of Chunks"`
+	ChunkOffs []int64  `json:"Chunk Offsets,omitempty"` // File offset where each chunk starts
+	Chunks    []string `json:"Chunks,omitempty"`        // Hash of each chunk, "" if only local
+	Target    string   `json:"Target,omitempty"`        // Of a symlink, it has no chunks
+	HardLink  bool     `json:"Hard Link,omitempty"`     // Other name of the file with the same Ino, that has the data
+}
+
+func (entry *Entry) IsLink() bool {
+	return entry.Stat.Mode&os.ModeSymlink != 0
+}
+
+// Who made a version, from which version and why
+type Version struct {
+	Name    string `json:"Name"`
+	Parent  string `json:"Parent,omitempty"`
+	Message string `json:"Message,omitempty"`
+	Author  string `json:"Author,omitempty"`
+	Time    int64  `json:"Time"` // Unix secs
+
+	// Size stats
+	Files     int   `json:"Files"`
+	Size      int64 `json:"Size"`       // Sum of file sizes
+	Chunks    int   `json:"Chunks"`     // Unique chunks
+	NewChunks int   `json:"New Chunks"` // Chunks not in parent
+
+	Root string `json:"Root Hash,omitempty"` // See RootHash
+}
+
+// Signature of a meta by its maker (see codec.SignMeta)
+type Signature struct {
+	Key string `json:"Key"` // Hex encoded ed25519 public key
+	Sig string `json:"Sig"` // Hex encoded
 }
 
 type Meta struct {
-	Config   Config  `json:"Config"`
-	CurrVer  string  `json:"Current Version"`
-	NumFiles int     `json:"Num Files"`
-	Entries  []Entry `json:"Entry List"`
+	Config    Config     `json:"Config"`
+	CurrVer   string     `json:"Current Version"`
+	History   []Version  `json:"History,omitempty"` // Oldest first, last is CurrVer - only appended to
+	NumFiles  int        `json:"Num Files"`
+	Root      string     `json:"Root Hash,omitempty"` // Of remote and committed versions, see RootHash
+	Entries   []Entry    `json:"Entry List"`
+	Signature *Signature `json:"Signature,omitempty"` // Of remote versions, if signed
+}
+
+// Record of the current version, nil if there is none
+func (M *Meta) Version() *Version {
+	if len(M.History) == 0 || M.History[len(M.History)-1].Name != M.CurrVer {
+		return nil
+	}
+	return &M.History[len(M.History)-1]
+}
+
+// Hashes of all chunks in Meta
+func ChunkSet(M *Meta) map[string]bool {
+	set := make(map[string]bool)
+	for _, entry := range M.Entries {
+		for _, hash := range entry.Chunks {
+			if hash != "" {
+				set[hash] = true
+			}
+		}
+	}
+	return set
+}
+
+var (
+	ErrBadRoot = errors.New("meta does not match its root hash")
+	ErrNoRoot  = errors.New("meta has no root hash")
+)
+
+// Root hash of Meta, hex encoded - merkle root of its entries, with its
+// config and history
+//  - Leaf of an entry is the sha256 of its path below the root dir, stat,
+//    chunk offsets and chunk hashes. Leaves are sorted by path, so the
+//    order of entries in the meta does not matter.
+//  - Each level hashes pairs of the level below, an odd last is moved up
+//  - Merkle root is hashed with config, current version and the version
+//    records - except root hash of the current one, which is this hash
+//  - Same root hash is same files with same content, as chunk hashes are
+//    of the content, in the same version of a horcrux
+func RootHash(M *Meta) string {
+	if len(M.Entries) == 0 {
+		return ""
+	}
+
+	type leaf struct {
+		path string
+		hash []byte
+	}
+
+	leaves := make([]leaf, len(M.Entries))
+	for i := range M.Entries {
+		entry := &M.Entries[i]
+		path := relPath(entry)
+
+		h := sha256.New()
+		h.Write([]byte{0})
+		fmt.Fprintf(h, "%q %t %o %d %d %d %d %d\n", path, entry.IsDir, uint32(entry.Stat.Mode),
+			entry.Stat.Size, entry.Stat.Uid, entry.Stat.Gid, entry.Stat.Mtime, entry.NumChunks)
+		for idx, hash := range entry.Chunks {
+			var off int64
+			if idx < len(entry.ChunkOffs) {
+				off = entry.ChunkOffs[idx]
+			}
+			fmt.Fprintf(h, "%d %s\n", off, hash)
+		}
+		// Not in root hashes of metas before symlinks and hard links
+		if entry.Target != "" {
+			fmt.Fprintf(h, "-> %q\n", entry.Target)
+		}
+		if entry.HardLink {
+			fmt.Fprintf(h, "= %d\n", entry.Ino)
+		}
+		leaves[i] = leaf{path, h.Sum(nil)}
+	}
+
+	sort.Slice(leaves, func(i, j int) bool { return leaves[i].path < leaves[j].path })
+
+	level := make([][]byte, len(leaves))
+	for i := range leaves {
+		level[i] = leaves[i].hash
+	}
+
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+
+			h := sha256.New()
+			h.Write([]byte{1})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+
+	h := sha256.New()
+	h.Write([]byte{2})
+	h.Write(level[0])
+	cfg := &M.Config
+	fmt.Fprintf(h, "%q %d %d %d %d %q %q %q\n", cfg.Version, cfg.ChunkType, cfg.ChunkSize,
+		cfg.MinChunkSize, cfg.MaxChunkSize, cfg.Codec, cfg.Encryption, cfg.KeyId)
+	fmt.Fprintf(h, "%q\n", M.CurrVer)
+	for i := range M.History {
+		ver := &M.History[i]
+		root := ver.Root
+		if ver.Name == M.CurrVer {
+			root = ""
+		}
+		fmt.Fprintf(h, "%q %q %q %q %d %d %d %d %d %q\n", ver.Name, ver.Parent, ver.Message, ver.Author,
+			ver.Time, ver.Files, ver.Size, ver.Chunks, ver.NewChunks, root)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Path of entry below the root dir, "" for the root
+func relPath(entry *Entry) string {
+	if entry.Prefix == "" {
+		return ""
+	}
+
+	if n := strings.Index(entry.Prefix, "/"); n >= 0 {
+		return entry.Prefix[n+1:] + "/" + entry.Name
+	}
+	return entry.Name
+}
+
+// Sets inodes of entries of M that have none, or one taken by an entry
+// before it. Entries with the same path in prev (if given) get its inode.
+// Root is ROOTINO. Hard links keep the inode of their file. Returns the
+// next free inode.
+func SetInodes(M *Meta, prev *Meta) uint64 {
+	next := uint64(ROOTINO + 1)
+	prevInos := make(map[string]uint64)
+	if prev != nil {
+		for i := range prev.Entries {
+			entry := &prev.Entries[i]
+			if entry.Ino >= next {
+				next = entry.Ino + 1
+			}
+			if entry.Ino != 0 {
+				prevInos[relPath(entry)+"/"+strconv.FormatBool(entry.IsDir)] = entry.Ino
+			}
+		}
+	}
+
+	for i := range M.Entries {
+		if M.Entries[i].Ino >= next {
+			next = M.Entries[i].Ino + 1
+		}
+	}
+
+	used := make(map[uint64]bool)
+	for i := range M.Entries {
+		entry := &M.Entries[i]
+		if entry.HardLink {
+			continue
+		}
+
+		if i == 0 {
+			entry.Ino = ROOTINO
+		} else if entry.Ino == 0 {
+			entry.Ino = prevInos[relPath(entry)+"/"+strconv.FormatBool(entry.IsDir)]
+		}
+
+		if entry.Ino == 0 || used[entry.Ino] {
+			entry.Ino = next
+			next++
+		}
+		used[entry.Ino] = true
+	}
+
+	// Hard link without its file is a file of its own, with no data
+	for i := range M.Entries {
+		entry := &M.Entries[i]
+		if entry.HardLink && !used[entry.Ino] {
+			entry.HardLink = false
+			entry.Ino = next
+			entry.Stat.Size = 0
+			next++
+		}
+	}
+
+	return next
+}
+
+// Checks root hash of Meta, and of its version record
+//  - Only a working meta can have none, required is false for it
+func CheckRoot(M *Meta, required bool) error {
+	if M.Root == "" {
+		if required {
+			return ErrNoRoot
+		}
+		return nil
+	}
+
+	if RootHash(M) != M.Root {
+		return ErrBadRoot
+	}
+
+	if ver := M.Version(); ver != nil && ver.Root != "" && ver.Root != M.Root {
+		return ErrBadRoot
+	}
+
+	return nil
+}
+
+// Fills size stats of ver from Meta - parent has the chunks of the parent version
+func VersionStats(ver *Version, M *Meta, parent map[string]bool) {
+	chunks := ChunkSet(M)
+
+	ver.Files, ver.Size = 0, 0
+	for _, entry := range M.Entries {
+		if !entry.IsDir {
+			ver.Files++
+		}
+		// Data of hard links is in their file
+		if !entry.IsDir && !entry.HardLink {
+			ver.Size += entry.Stat.Size
+		}
+	}
+
+	ver.Chunks = len(chunks)
+	ver.NewChunks = 0
+	for hash := range chunks {
+		if !parent[hash] {
+			ver.NewChunks++
+		}
+	}
 }
@@ -0,0 +1,142 @@
+package horcrux
+
+import (
+	"os"
+	"testing"
+)
+
+// Root dir T, with file T/a and T/d/b
+func testMeta() *Meta {
+	return &Meta{
+		Config:  Config{ChunkType: CHUNK_TYPE_STATIC, ChunkSize: 4},
+		CurrVer: "v2",
+		History: []Version{{Name: "v1", Time: 10, Root: "r1"}, {Name: "v2", Parent: "v1", Time: 20}},
+		Entries: []Entry{
+			{Name: "T", IsDir: true, Stat: Stat{Mode: os.ModeDir | 0755}},
+			{Name: "a", Prefix: "T", Stat: Stat{Mode: 0644, Size: 3, Mtime: 100}, NumChunks: 1,
+				ChunkOffs: []int64{0}, Chunks: []string{"aaaa"}},
+			{Name: "d", Prefix: "T", IsDir: true, Stat: Stat{Mode: os.ModeDir | 0755}},
+			{Name: "b", Prefix: "T/d", Stat: Stat{Mode: 0600, Size: 8, Mtime: 200}, NumChunks: 2,
+				ChunkOffs: []int64{0, 4}, Chunks: []string{"bbbb", "cccc"}},
+		},
+	}
+}
+
+func TestRootHash(t *testing.T) {
+	root := RootHash(testMeta())
+
+	changes := map[string]func(M *Meta){
+		"path":         func(M *Meta) { M.Entries[3].Prefix = "T" },
+		"mode":         func(M *Meta) { M.Entries[1].Stat.Mode = 0755 },
+		"size":         func(M *Meta) { M.Entries[1].Stat.Size++ },
+		"owner":        func(M *Meta) { M.Entries[1].Stat.Uid = 1 },
+		"mtime":        func(M *Meta) { M.Entries[3].Stat.Mtime++ },
+		"chunk hash":   func(M *Meta) { M.Entries[3].Chunks[1] = "dddd" },
+		"chunk offset": func(M *Meta) { M.Entries[3].ChunkOffs[1] = 5 },
+		"new entry":    func(M *Meta) { M.Entries = append(M.Entries, Entry{Name: "c", Prefix: "T"}) },
+		"link target":  func(M *Meta) { M.Entries[1].Target = "d/b" },
+		"hard link":    func(M *Meta) { M.Entries[1].HardLink = true },
+		"config":       func(M *Meta) { M.Config.ChunkSize = 8 },
+		"version":      func(M *Meta) { M.CurrVer = "v1" },
+		"record":       func(M *Meta) { M.History[1].Message = "x" },
+		"old root":     func(M *Meta) { M.History[0].Root = "r0" },
+		"old record":   func(M *Meta) { M.History = M.History[1:] },
+	}
+	for name, change := range changes {
+		M := testMeta()
+		change(M)
+		if RootHash(M) == root {
+			t.Errorf("%v changed, root hash did not", name)
+		}
+	}
+
+	// Order of entries does not matter
+	M := testMeta()
+	M.Entries[1], M.Entries[3] = M.Entries[3], M.Entries[1]
+	if RootHash(M) != root {
+		t.Error("root hash changed with entry order")
+	}
+
+	// Record of the current version has this root hash
+	M = testMeta()
+	M.History[1].Root = root
+	if RootHash(M) != root {
+		t.Error("root hash changed with its own record")
+	}
+}
+
+func TestCheckRoot(t *testing.T) {
+	M := testMeta()
+	M.Root = RootHash(M)
+	M.History[1].Root = M.Root
+	if err := CheckRoot(M, true); err != nil {
+		t.Fatal(err)
+	}
+
+	M.History[1].Author = "x"
+	if err := CheckRoot(M, true); err != ErrBadRoot {
+		t.Errorf("tampered history: %v", err)
+	}
+
+	M = testMeta()
+	M.Root = RootHash(M)
+	M.Entries[1].Chunks[0] = "eeee"
+	if err := CheckRoot(M, false); err != ErrBadRoot {
+		t.Errorf("tampered meta: %v", err)
+	}
+
+	// Only a working meta can have none
+	if err := CheckRoot(testMeta(), true); err != ErrNoRoot {
+		t.Errorf("no root: %v", err)
+	}
+	if err := CheckRoot(testMeta(), false); err != nil {
+		t.Errorf("working meta: %v", err)
+	}
+}
+
+func TestSetInodes(t *testing.T) {
+	prev := testMeta()
+	if next := SetInodes(prev, nil); next != ROOTINO+4 || prev.Entries[0].Ino != ROOTINO {
+		t.Fatalf("next inode %v, root %v", next, prev.Entries[0].Ino)
+	}
+
+	// Same paths keep their inodes, a new one gets the next free one
+	M := testMeta()
+	M.Entries[1].Name = "c"
+	if next := SetInodes(M, prev); next != ROOTINO+5 {
+		t.Errorf("next inode %v", next)
+	}
+	for i, want := range []uint64{1, 5, 3, 4} {
+		if M.Entries[i].Ino != want {
+			t.Errorf("%v: inode %v, want %v", M.Entries[i].Name, M.Entries[i].Ino, want)
+		}
+	}
+
+	// Renamed in a mount, the inode goes with it - one taken is not reused
+	M = testMeta()
+	M.Entries[1].Name = "c"
+	M.Entries[1].Ino = 2
+	M.Entries[3].Ino = 2
+	SetInodes(M, prev)
+	if M.Entries[1].Ino != 2 || M.Entries[3].Ino != 5 {
+		t.Errorf("inodes %v and %v", M.Entries[1].Ino, M.Entries[3].Ino)
+	}
+}
+
+func TestSetInodesHardLink(t *testing.T) {
+	M := testMeta()
+	M.Entries = append(M.Entries,
+		Entry{Name: "l", Prefix: "T", Ino: 9, HardLink: true},
+		Entry{Name: "x", Prefix: "T", Ino: 20, HardLink: true})
+	M.Entries[3].Ino = 9
+
+	next := SetInodes(M, nil)
+	if M.Entries[4].Ino != M.Entries[3].Ino || !M.Entries[4].HardLink {
+		t.Errorf("hard link inode %v, file %v", M.Entries[4].Ino, M.Entries[3].Ino)
+	}
+
+	// Its file is gone - a file of its own
+	if x := M.Entries[5]; x.HardLink || x.Ino == 20 || x.Ino != next-1 {
+		t.Errorf("hard link without file: %+v, next %v", x, next)
+	}
+}
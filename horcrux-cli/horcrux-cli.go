@@ -1,24 +1,27 @@
 /*
  * TODO:
  *	- SetAttr
- *	- Rename
  *	- Fix "du" ?
  *	- clean-up cache dirs for removed dirs/files
  */
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
 	"os/user"
+	"sort"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/codegangsta/cli"
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/codec"
 	"github.com/muthu-r/horcrux/reducto"
 	"github.com/muthu-r/horcrux/revelo"
 )
@@ -27,14 +30,23 @@ const (
 	WORKDIR = ".horcrux"
 )
 
-func createWorkDirs(name string) (string, error) {
+func getWorkDir() (string, error) {
 	usr, err := user.Current()
 	if err != nil {
 		fmt.Printf("Cannot get user info - error %v\n", err)
 		return "", err
 	}
 
-	cd := usr.HomeDir + "/" + WORKDIR + "/" + name
+	return usr.HomeDir + "/" + WORKDIR, nil
+}
+
+func createWorkDirs(name string) (string, error) {
+	wd, err := getWorkDir()
+	if err != nil {
+		return "", err
+	}
+
+	cd := wd + "/" + name
 	err = os.MkdirAll(cd, 0700)
 	if err != nil {
 		fmt.Printf("Cannot create cachedir dir %v\n", cd)
@@ -125,20 +137,50 @@ func getChunkSize(chunksz string) int {
 	return chunkSz
 }
 
+func getChunkType(chunktype string) int {
+	switch chunktype {
+	case "static", "":
+		return horcrux.CHUNK_TYPE_STATIC
+	case "rollsum":
+		return horcrux.CHUNK_TYPE_ROLLSUM
+	}
+
+	fmt.Printf("Invalid chunk type %v, using static\n", chunktype)
+	return horcrux.CHUNK_TYPE_STATIC
+}
+
 func generate(c *cli.Context) {
 	if len(c.Args()) != 3 {
 		fmt.Printf("Generate: Invalid arguments\n")
 		cli.ShowSubcommandHelp(c)
 		return
 	}
-	chunkSize := getChunkSize(chunksz)
-	fmt.Printf("Generate: chunk sz %v\n", chunkSize)
-
 	horName := c.Args()[0]
 	inPath := c.Args()[1]
 	outPath := c.Args()[2]
 
-	err := reducto.Reducto(horcrux.CHUNK_TYPE_STATIC, chunkSize, horName, inPath, outPath)
+	key, err := codec.LoadKey(keyfile)
+	if err != nil {
+		fmt.Printf("Generate: Cannot get key: err = %v\n", err)
+		return
+	}
+
+	signKey, err := codec.LoadSignKey(signkeyfile)
+	if err != nil {
+		fmt.Printf("Generate: Cannot get sign key: err = %v\n", err)
+		return
+	}
+
+	if update {
+		// Chunking and compression are same as the existing horcrux
+		fmt.Printf("Generate: next version of %v in %v\n", horName, outPath)
+		err = reducto.Update(key, signKey, message, horName, inPath, outPath)
+	} else {
+		chunkSize := getChunkSize(chunksz)
+		chunkType := getChunkType(chunktype)
+		fmt.Printf("Generate: chunk sz %v, type %v, compress %v\n", chunkSize, chunktype, compress)
+		err = reducto.Reducto(chunkType, chunkSize, compress, key, signKey, message, horName, inPath, outPath)
+	}
 	if err != nil {
 		fmt.Printf("Generate failed: err = %v\n", err)
 		return
@@ -159,10 +201,23 @@ func mount(c *cli.Context) {
 	accessArgs := c.Args()[1]
 	mntDir := c.Args()[2]
 
+	key, err := codec.LoadKey(keyfile)
+	if err != nil {
+		fmt.Printf("Mount: Cannot get key: err = %v\n", err)
+		return
+	}
+
+	trusted, err := codec.LoadTrustedKeys(trustedfile)
+	if err != nil {
+		fmt.Printf("Mount: Cannot get trusted keys: err = %v\n", err)
+		return
+	}
+
 	handleSignals(mntDir)
 
 	cacheDir, err := createWorkDirs(horName)
-	err = revelo.Revelo(horName, accessArgs, cacheDir, mntDir)
+	opts := revelo.MountOpts{Version: version, ReadOnly: readonly, Verify: verifyMode, Trusted: trusted}
+	err = revelo.Revelo(horName, accessArgs, key, cacheDir, mntDir, opts)
 	if err != nil {
 		log.Errorf("Cannot mount - err: %v\n", err)
 		return
@@ -171,7 +226,659 @@ func mount(c *cli.Context) {
 	return
 }
 
+func verify(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Printf("Verify: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	horName := c.Args()[0]
+
+	key, err := codec.LoadKey(keyfile)
+	if err != nil {
+		fmt.Printf("Verify: Cannot get key: err = %v\n", err)
+		return
+	}
+
+	cacheDir, err := createWorkDirs(horName)
+	if err != nil {
+		return
+	}
+
+	checked, bad, err := revelo.Verify(horName, key, cacheDir)
+	if err != nil {
+		fmt.Printf("Verify failed: err = %v\n", err)
+		return
+	}
+
+	fmt.Printf("Verify done... %v chunks checked, %v bad chunks removed\n", checked, bad)
+	return
+}
+
+// Runs req on the mount at req.MntDir
+func control(cmd string, req *revelo.CtlRequest) (*revelo.CtlResponse, error) {
+	wd, err := getWorkDir()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := revelo.Control(wd, req)
+	if err != nil {
+		fmt.Printf("%v failed: err = %v\n", cmd, err)
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func commit(c *cli.Context) {
+	if len(c.Args()) != 1 || message == "" {
+		fmt.Printf("Commit: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	if author == "" {
+		if usr, err := user.Current(); err == nil {
+			author = usr.Username
+		}
+	}
+
+	req := &revelo.CtlRequest{Cmd: revelo.CTL_COMMIT, MntDir: c.Args()[0], Message: message, Author: author}
+	resp, err := control("Commit", req)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("Commit done... version %v\n", resp.Version)
+	return
+}
+
+// Local changes of the mount at mntDir, from its base version
+func changes(cmd string, mntDir string) (*revelo.CtlResponse, error) {
+	req := &revelo.CtlRequest{Cmd: revelo.CTL_STATUS, MntDir: mntDir}
+	return control(cmd, req)
+}
+
+func status(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Printf("Status: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	resp, err := changes("Status", c.Args()[0])
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("On version %v, %v changes\n", resp.Version, len(resp.Changes))
+	for _, ch := range resp.Changes {
+		name := ch.Path
+		if ch.IsDir {
+			name += "/"
+		}
+		fmt.Printf("    %-10v %v\n", ch.Type+":", name)
+	}
+	return
+}
+
+func diff(c *cli.Context) {
+	switch len(c.Args()) {
+	case 1:
+		diffLocal(c.Args()[0])
+	case 4:
+		diffVersions(c.Args()[0], c.Args()[1], c.Args()[2], c.Args()[3])
+	default:
+		fmt.Printf("Diff: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+	}
+	return
+}
+
+// Local changes of the mount at mntDir
+func diffLocal(mntDir string) {
+	resp, err := changes("Diff", mntDir)
+	if err != nil {
+		return
+	}
+
+	if jsonOut {
+		printJSON(resp.Changes)
+		return
+	}
+
+	for _, ch := range resp.Changes {
+		name := ch.Path
+		if ch.IsDir {
+			name += "/"
+		}
+		fmt.Printf("%v %v\n", ch.Type, name)
+		for _, rg := range ch.Ranges {
+			fmt.Printf("    @@ %v-%v (%v bytes)\n", rg.Off, rg.Off+rg.Len, rg.Len)
+		}
+	}
+}
+
+// Changes between two remote versions
+func diffVersions(horName string, accessArgs string, from string, to string) {
+	key, err := codec.LoadKey(keyfile)
+	if err != nil {
+		fmt.Printf("Diff: Cannot get key: err = %v\n", err)
+		return
+	}
+
+	cacheDir, err := createWorkDirs(horName)
+	if err != nil {
+		return
+	}
+
+	d, err := revelo.DiffVersions(horName, accessArgs, key, cacheDir, from, to)
+	if err != nil {
+		fmt.Printf("Diff failed: err = %v\n", err)
+		return
+	}
+
+	if jsonOut {
+		printJSON(d)
+		return
+	}
+
+	for _, ch := range d.Changes {
+		name := ch.Path
+		if ch.IsDir {
+			name += "/"
+		}
+
+		fmt.Printf("%-10v %v", ch.Type+":", name)
+		if !ch.IsDir {
+			fmt.Printf(" (%v chunks, %v bytes)", ch.Chunks, ch.Bytes)
+		}
+		if ch.Old != nil && ch.New != nil {
+			if ch.Old.Mode != ch.New.Mode {
+				fmt.Printf(" mode %v -> %v", ch.Old.Mode, ch.New.Mode)
+			}
+			if ch.Old.Uid != ch.New.Uid || ch.Old.Gid != ch.New.Gid {
+				fmt.Printf(" owner %v:%v -> %v:%v", ch.Old.Uid, ch.Old.Gid, ch.New.Uid, ch.New.Gid)
+			}
+			if !ch.IsDir && ch.Old.Size != ch.New.Size {
+				fmt.Printf(" size %v -> %v", ch.Old.Size, ch.New.Size)
+			}
+		}
+		fmt.Printf("\n")
+	}
+
+	fmt.Printf("%v -> %v: %v added, %v removed, %v modified - %v chunks, %v bytes changed, %v new chunks\n",
+		d.From, d.To, d.Added, d.Removed, d.Modified, d.Chunks, d.Bytes, d.NewChunks)
+}
+
+func printJSON(v interface{}) {
+	js, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		fmt.Printf("Cannot marshal: err = %v\n", err)
+		return
+	}
+	fmt.Printf("%s\n", js)
+}
+
+func resetVol(c *cli.Context) {
+	if len(c.Args()) < 1 {
+		fmt.Printf("Reset: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	paths := []string(c.Args()[1:])
+	if len(paths) == 0 && !hard {
+		fmt.Printf("Reset: Dropping all local changes needs --hard\n")
+		return
+	}
+
+	req := &revelo.CtlRequest{Cmd: revelo.CTL_RESET, MntDir: c.Args()[0], Paths: paths}
+	resp, err := control("Reset", req)
+	if err != nil {
+		return
+	}
+
+	for _, ch := range resp.Changes {
+		fmt.Printf("    %-10v %v\n", ch.Type+":", ch.Path)
+	}
+	fmt.Printf("Reset done... %v changes dropped, at version %v\n", len(resp.Changes), resp.Version)
+	return
+}
+
+func pull(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Printf("Pull: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	wd, err := getWorkDir()
+	if err != nil {
+		return
+	}
+
+	req := &revelo.CtlRequest{Cmd: revelo.CTL_PULL, MntDir: c.Args()[0]}
+	resp, err := revelo.Control(wd, req)
+	if err != nil {
+		fmt.Printf("Pull failed: err = %v\n", err)
+		if resp != nil && len(resp.Changes) > 0 {
+			fmt.Printf("Conflicts (changed both locally and in remote):\n")
+			for _, ch := range resp.Changes {
+				fmt.Printf("    %-10v %v\n", ch.Type+":", ch.Path)
+			}
+		}
+		return
+	}
+
+	for _, ch := range resp.Changes {
+		fmt.Printf("    %-10v %v\n", ch.Type+":", ch.Path)
+	}
+	fmt.Printf("Pull done... %v changes, at version %v\n", len(resp.Changes), resp.Version)
+	return
+}
+
+func gc(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Printf("GC: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	key, err := codec.LoadKey(keyfile)
+	if err != nil {
+		fmt.Printf("GC: Cannot get key: err = %v\n", err)
+		return
+	}
+
+	// Only tmp files here - not of any one horcrux
+	wd, err := getWorkDir()
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(wd, 0700); err != nil {
+		fmt.Printf("Cannot create work dir %v\n", wd)
+		return
+	}
+
+	res, err := revelo.GC(c.Args()[0], key, wd, grace, dryRun)
+	if err != nil {
+		fmt.Printf("GC failed: err = %v\n", err)
+		return
+	}
+
+	if jsonOut {
+		printJSON(res)
+		return
+	}
+
+	deleted := "deleted"
+	if dryRun {
+		deleted = "to delete"
+	}
+	for _, name := range res.Deleted {
+		fmt.Printf("    %v: %v\n", deleted, name)
+	}
+	fmt.Printf("GC done... %v metas, %v chunks, %v live, %v %v (%v bytes), %v unreferenced for less than %v\n",
+		res.Metas, res.Chunks, res.Live, len(res.Deleted), deleted, res.Bytes, res.Marked, grace)
+	return
+}
+
+// Prunes versions, then marks (or deletes) their chunks with gc
+//   <access-type> [names...]
+func prune(c *cli.Context) {
+	if len(c.Args()) < 1 {
+		fmt.Printf("Prune: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	key, err := codec.LoadKey(keyfile)
+	if err != nil {
+		fmt.Printf("Prune: Cannot get key: err = %v\n", err)
+		return
+	}
+
+	wd, err := getWorkDir()
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(wd, 0700); err != nil {
+		fmt.Printf("Cannot create work dir %v\n", wd)
+		return
+	}
+
+	policy := revelo.PrunePolicy{KeepLast: keepLast, KeepDaily: keepDaily, KeepTagged: keepTagged}
+	results, err := revelo.Prune(c.Args()[0], c.Args()[1:], key, wd, policy, dryRun)
+	if err != nil {
+		fmt.Printf("Prune failed: err = %v\n", err)
+		return
+	}
+
+	if jsonOut {
+		printJSON(results)
+	} else {
+		removed := "removed"
+		if dryRun {
+			removed = "to remove"
+		}
+		for _, res := range results {
+			fmt.Printf("%v: %v kept, %v %v\n", res.Name, len(res.Kept), len(res.Removed), removed)
+			for _, ver := range res.Removed {
+				fmt.Printf("    %v: %v\n", removed, ver)
+			}
+			for _, ref := range res.Refs {
+				fmt.Printf("    %v ref: %v\n", removed, ref)
+			}
+		}
+	}
+
+	if dryRun {
+		return
+	}
+
+	res, err := revelo.GC(c.Args()[0], key, wd, grace, false)
+	if err != nil {
+		fmt.Printf("Prune: GC failed: err = %v\n", err)
+		return
+	}
+	if !jsonOut {
+		fmt.Printf("GC done... %v chunks deleted (%v bytes), %v unreferenced for less than %v\n",
+			len(res.Deleted), res.Bytes, res.Marked, grace)
+	}
+	return
+}
+
+func tag(c *cli.Context) {
+	refCmd(c, revelo.REF_TAG)
+}
+
+func branch(c *cli.Context) {
+	refCmd(c, revelo.REF_BRANCH)
+}
+
+// Lists, sets or deletes refs of kind
+//   <name> <access-type> [<ref> [<version>]]
+func refCmd(c *cli.Context, kind string) {
+	if len(c.Args()) < 2 || len(c.Args()) > 4 || (del && len(c.Args()) != 3) {
+		fmt.Printf("%v: Invalid arguments\n", kind)
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	horName := c.Args()[0]
+	accessArgs := c.Args()[1]
+
+	key, err := codec.LoadKey(keyfile)
+	if err != nil {
+		fmt.Printf("%v: Cannot get key: err = %v\n", kind, err)
+		return
+	}
+
+	cacheDir, err := createWorkDirs(horName)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case len(c.Args()) == 2:
+		refs, err := revelo.ListRefs(horName, accessArgs, key, cacheDir)
+		if err != nil {
+			fmt.Printf("%v failed: err = %v\n", kind, err)
+			return
+		}
+
+		refMap := refs.Tags
+		if kind == revelo.REF_BRANCH {
+			refMap = refs.Branches
+		}
+
+		var names []string
+		for name := range refMap {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%v -> %v\n", name, refMap[name])
+		}
+
+	case del:
+		err = revelo.DeleteRef(horName, accessArgs, key, cacheDir, kind, c.Args()[2])
+		if err != nil {
+			fmt.Printf("%v failed: err = %v\n", kind, err)
+			return
+		}
+		fmt.Printf("Deleted %v %v\n", kind, c.Args()[2])
+
+	default:
+		ver := ""
+		if len(c.Args()) == 4 {
+			ver = c.Args()[3]
+		}
+
+		ver, err = revelo.SetRef(horName, accessArgs, key, cacheDir, kind, c.Args()[2], ver, force)
+		if err != nil {
+			fmt.Printf("%v failed: err = %v\n", kind, err)
+			return
+		}
+		fmt.Printf("%v %v -> %v\n", kind, c.Args()[2], ver)
+	}
+	return
+}
+
+func push(c *cli.Context) {
+	if len(c.Args()) != 2 {
+		fmt.Printf("Push: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	horName := c.Args()[0]
+	accessArgs := c.Args()[1]
+
+	key, err := codec.LoadKey(keyfile)
+	if err != nil {
+		fmt.Printf("Push: Cannot get key: err = %v\n", err)
+		return
+	}
+
+	cacheDir, err := createWorkDirs(horName)
+	if err != nil {
+		return
+	}
+
+	signKey, err := codec.LoadSignKey(signkeyfile)
+	if err != nil {
+		fmt.Printf("Push: Cannot get sign key: err = %v\n", err)
+		return
+	}
+
+	ver, err := revelo.Push(horName, accessArgs, key, signKey, cacheDir)
+	if err != nil {
+		fmt.Printf("Push failed: err = %v\n", err)
+		return
+	}
+
+	fmt.Printf("Push done... remote at version %v\n", ver)
+	return
+}
+
+// New sign key in key-file, prints its public key - for trusted keys files
+func keygen(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Printf("Keygen: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	priv, _, err := codec.NewSignKey()
+	if err != nil {
+		fmt.Printf("Keygen failed: err = %v\n", err)
+		return
+	}
+
+	f, err := os.OpenFile(c.Args()[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fmt.Printf("Keygen: Cannot create key file: err = %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%x\n", []byte(priv)); err != nil {
+		fmt.Printf("Keygen: Cannot write key file: err = %v\n", err)
+		return
+	}
+
+	fmt.Printf("%v\n", codec.PublicKey(priv))
+	return
+}
+
+func history(c *cli.Context) {
+	if len(c.Args()) != 2 {
+		fmt.Printf("Log: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	horName := c.Args()[0]
+	accessArgs := c.Args()[1]
+
+	key, err := codec.LoadKey(keyfile)
+	if err != nil {
+		fmt.Printf("Log: Cannot get key: err = %v\n", err)
+		return
+	}
+
+	cacheDir, err := createWorkDirs(horName)
+	if err != nil {
+		return
+	}
+
+	vers, err := revelo.Log(horName, accessArgs, key, cacheDir)
+	if err != nil {
+		fmt.Printf("Log failed: err = %v\n", err)
+		return
+	}
+
+	// Latest first
+	for i := len(vers) - 1; i >= 0; i-- {
+		v := vers[i]
+		fmt.Printf("version %v", v.Name)
+		if v.Parent != "" {
+			fmt.Printf(" (parent %v)", v.Parent)
+		}
+		fmt.Printf("\n")
+
+		if v.Time == 0 {
+			fmt.Printf("    (no history)\n\n")
+			continue
+		}
+
+		fmt.Printf("Author: %v\n", v.Author)
+		fmt.Printf("Date:   %v\n", time.Unix(v.Time, 0).Format(time.RFC1123))
+		fmt.Printf("Size:   %v files, %v bytes, %v chunks (%v new)\n", v.Files, v.Size, v.Chunks, v.NewChunks)
+		if v.Root != "" {
+			fmt.Printf("Root:   %v\n", v.Root)
+		}
+		fmt.Printf("\n    %v\n\n", v.Message)
+	}
+	return
+}
+
+func info(c *cli.Context) {
+	if len(c.Args()) < 2 || len(c.Args()) > 3 {
+		fmt.Printf("Info: Invalid arguments\n")
+		cli.ShowSubcommandHelp(c)
+		return
+	}
+
+	horName := c.Args()[0]
+	accessArgs := c.Args()[1]
+	ver := ""
+	if len(c.Args()) == 3 {
+		ver = c.Args()[2]
+	}
+
+	key, err := codec.LoadKey(keyfile)
+	if err != nil {
+		fmt.Printf("Info: Cannot get key: err = %v\n", err)
+		return
+	}
+
+	cacheDir, err := createWorkDirs(horName)
+	if err != nil {
+		return
+	}
+
+	i, err := revelo.Info(horName, accessArgs, key, cacheDir, ver)
+	if err != nil {
+		fmt.Printf("Info failed: err = %v\n", err)
+		return
+	}
+
+	if jsonOut {
+		printJSON(i)
+		return
+	}
+
+	fmt.Printf("Name:      %v\n", i.Name)
+	fmt.Printf("Version:   %v\n", i.Version)
+	fmt.Printf("Root:      %v\n", i.Root)
+	fmt.Printf("Size:      %v files, %v bytes, %v chunks\n", i.Files, i.Size, i.Chunks)
+	fmt.Printf("Chunking:  type %v, size %v", i.Config.ChunkType, i.Config.ChunkSize)
+	if i.Config.Codec != "" {
+		fmt.Printf(", %v", i.Config.Codec)
+	}
+	if i.Config.Encryption != "" {
+		fmt.Printf(", %v", i.Config.Encryption)
+	}
+	fmt.Printf("\n")
+	if i.Record != nil && i.Record.Time != 0 {
+		fmt.Printf("Author:    %v\n", i.Record.Author)
+		fmt.Printf("Date:      %v\n", time.Unix(i.Record.Time, 0).Format(time.RFC1123))
+		fmt.Printf("Message:   %v\n", i.Record.Message)
+	}
+	if i.SignedBy != "" {
+		fmt.Printf("Signed by: %v\n", i.SignedBy)
+	}
+	return
+}
+
+var keyFlag = cli.StringFlag {
+	Name: "keyfile, k",
+	Usage: "File with hex encoded 32 byte key to encrypt/decrypt horcrux (default: $" + codec.KEY_ENV + ")",
+	Destination: &keyfile,
+}
+
+var signKeyFlag = cli.StringFlag {
+	Name: "signkey",
+	Usage: "File with hex encoded ed25519 key to sign versions with (default: $" + codec.SIGNKEY_ENV + ")",
+	Destination: &signkeyfile,
+}
+
 var chunksz string
+var chunktype string
+var compress string
+var keyfile string
+var update bool
+var message string
+var version string
+var readonly bool
+var author string
+var hard bool
+var jsonOut bool
+var force bool
+var del bool
+var dryRun bool
+var grace time.Duration
+var keepLast int
+var keepDaily int
+var keepTagged bool
+var signkeyfile string
+var trustedfile string
+var verifyMode string
 var horCmds = []cli.Command {
 	{
 		Name:	"generate",
@@ -182,21 +889,283 @@ var horCmds = []cli.Command {
 			cli.StringFlag {
 				Name: "chunksize, s",
 				Value: horcrux.CHUNKSIZE_DEFAULT_STR,
-				Usage: "Chunk Size",
+				Usage: "Chunk Size (average size for rollsum)",
 				Destination: &chunksz,
 			},
+			cli.StringFlag {
+				Name: "chunktype, t",
+				Value: "static",
+				Usage: "Chunk Type: static or rollsum (content defined)",
+				Destination: &chunktype,
+			},
+			cli.StringFlag {
+				Name: "compress, c",
+				Value: horcrux.CODEC_NONE,
+				Usage: "Chunk compression: none, gzip or zstd",
+				Destination: &compress,
+			},
+			cli.BoolFlag {
+				Name: "update, u",
+				Usage: "Generate next version in existing <out-dir>, with only new or changed chunks",
+				Destination: &update,
+			},
+			cli.StringFlag {
+				Name: "message, m",
+				Usage: "Version message (default: generate/update from <in-dir>)",
+				Destination: &message,
+			},
+			keyFlag,
+			signKeyFlag,
 		},
 	},
 	{
 		Name:	"mount",
 		Aliases: []string{"m", "mnt"},
-		Usage: "<name> <access-type> <mnt-dir>\n" +
+		Usage: "[options] <name> <access-type> <mnt-dir>\n" +
 		       "   access-type is one of:\n" +
                        "       cp://full-path\n" +
                        "       scp://user::passwd@host:full-path (skip passwd, if auto-login is configured)\n" +
-                       "       s3://bucket@region (credentials in ~/.aws/credentials)\n" +
-                       "       minio://host:port/bucket (credentials in ~/.minio/horcrux.json)\n",
+                       "       s3://bucket@region (credentials in ~/.aws/credentials)\n",
 		Action: mount,
+		Flags: []cli.Flag {
+			keyFlag,
+			cli.StringFlag {
+				Name: "version, V",
+				Usage: "Version (v1, v2, ...) or tag/branch to mount, latest if not given",
+				Destination: &version,
+			},
+			cli.BoolFlag {
+				Name: "readonly, r",
+				Usage: "Mount read only",
+				Destination: &readonly,
+			},
+			cli.StringFlag {
+				Name: "trusted-keys, T",
+				Usage: "File with hex encoded public keys versions have to be signed by, one per line (default: file in $" + codec.TRUSTED_ENV + ")",
+				Destination: &trustedfile,
+			},
+			cli.StringFlag {
+				Name: "verify",
+				Usage: "For unsigned or badly signed versions: warn (default, if trusted keys are given), require (dont mount) or off",
+				Destination: &verifyMode,
+			},
+		},
+	},
+	{
+		Name:	"commit",
+		Aliases: []string{"c", "ci"},
+		Usage:	"-m <message> [options] <mnt-dir>\n" +
+		       "   saves changes in horcrux mounted at <mnt-dir> as a new local version\n",
+		Action: commit,
+		Flags: []cli.Flag {
+			cli.StringFlag {
+				Name: "message, m",
+				Usage: "Commit message",
+				Destination: &message,
+			},
+			cli.StringFlag {
+				Name: "author, a",
+				Usage: "Commit author (default: current user)",
+				Destination: &author,
+			},
+		},
+	},
+	{
+		Name:	"status",
+		Aliases: []string{"st"},
+		Usage:	"<mnt-dir>\n" +
+		       "   lists files added, removed or modified in horcrux mounted at <mnt-dir>, from the version it is on\n",
+		Action: status,
+	},
+	{
+		Name:	"diff",
+		Aliases: []string{"d"},
+		Usage:	"[options] <mnt-dir> | <name> <access-type> <version> <version>\n" +
+		       "   same as status, with the changed byte ranges of each file\n" +
+		       "   with versions or refs (v3 prod), compares two remote versions of <name> - no mount needed\n",
+		Action: diff,
+		Flags: []cli.Flag {
+			keyFlag,
+			cli.BoolFlag {
+				Name: "json, j",
+				Usage: "Output in JSON",
+				Destination: &jsonOut,
+			},
+		},
+	},
+	{
+		Name:	"reset",
+		Usage:	"[options] <mnt-dir> [paths...]\n" +
+		       "   drops local changes of paths (or all, with --hard) in horcrux mounted at <mnt-dir>,\n" +
+		       "   back to the version it is on. Cached chunks are kept.\n",
+		Action: resetVol,
+		Flags: []cli.Flag {
+			cli.BoolFlag {
+				Name: "hard",
+				Usage: "Drop all local changes, if no paths are given",
+				Destination: &hard,
+			},
+		},
+	},
+	{
+		Name:	"pull",
+		Usage:	"<mnt-dir>\n" +
+		       "   moves horcrux mounted at <mnt-dir> to the latest remote version, keeping local changes.\n" +
+		       "   Nothing is pulled if files changed both locally and in remote - they are listed as conflicts.\n",
+		Action: pull,
+	},
+	{
+		Name:	"gc",
+		Usage:	"[options] <access-type>\n" +
+		       "   deletes chunks in remote no version of any horcrux there refers to. A chunk is deleted\n" +
+		       "   only if an earlier gc found it unreferenced at least --grace ago - run it periodically.\n",
+		Action: gc,
+		Flags: []cli.Flag {
+			keyFlag,
+			cli.BoolFlag {
+				Name: "dry-run, n",
+				Usage: "Only list chunks that would be deleted, change nothing",
+				Destination: &dryRun,
+			},
+			cli.DurationFlag {
+				Name: "grace, g",
+				Value: revelo.GC_GRACE,
+				Usage: "Time chunks stay unreferenced before they are deleted",
+				Destination: &grace,
+			},
+			cli.BoolFlag {
+				Name: "json, j",
+				Usage: "Output in JSON",
+				Destination: &jsonOut,
+			},
+		},
+	},
+	{
+		Name:	"prune",
+		Usage:	"[options] <access-type> [names...]\n" +
+		       "   removes versions of horcruxes in remote (all, if no names) not kept by the options - latest\n" +
+		       "   is always kept. Chunks of removed versions are deleted by gc, after --grace.\n",
+		Action: prune,
+		Flags: []cli.Flag {
+			keyFlag,
+			cli.IntFlag {
+				Name: "keep-last, l",
+				Usage: "Keep the N latest versions",
+				Destination: &keepLast,
+			},
+			cli.IntFlag {
+				Name: "keep-daily, d",
+				Usage: "Keep the latest version of each of the D latest days with versions",
+				Destination: &keepDaily,
+			},
+			cli.BoolFlag {
+				Name: "keep-tagged, t",
+				Usage: "Keep versions with tags or branches (else refs to removed versions are removed too)",
+				Destination: &keepTagged,
+			},
+			cli.BoolFlag {
+				Name: "dry-run, n",
+				Usage: "Only list versions that would be removed, change nothing",
+				Destination: &dryRun,
+			},
+			cli.DurationFlag {
+				Name: "grace, g",
+				Value: revelo.GC_GRACE,
+				Usage: "Time chunks stay unreferenced before gc deletes them",
+				Destination: &grace,
+			},
+			cli.BoolFlag {
+				Name: "json, j",
+				Usage: "Output in JSON",
+				Destination: &jsonOut,
+			},
+		},
+	},
+	{
+		Name:	"tag",
+		Usage:	"[options] <name> <access-type> [<tag> [<version>]]\n" +
+		       "   lists tags of <name> in remote, or sets <tag> to <version> (or tag/branch), latest if not given\n",
+		Action: tag,
+		Flags: []cli.Flag {
+			keyFlag,
+			cli.BoolFlag {
+				Name: "force, f",
+				Usage: "Move the tag, if it exists",
+				Destination: &force,
+			},
+			cli.BoolFlag {
+				Name: "delete, d",
+				Usage: "Delete the tag",
+				Destination: &del,
+			},
+		},
+	},
+	{
+		Name:	"branch",
+		Usage:	"[options] <name> <access-type> [<branch> [<version>]]\n" +
+		       "   lists branches of <name> in remote, or creates/moves <branch> to <version> (or tag/branch), latest if not given\n",
+		Action: branch,
+		Flags: []cli.Flag {
+			keyFlag,
+			cli.BoolFlag {
+				Name: "delete, d",
+				Usage: "Delete the branch",
+				Destination: &del,
+			},
+		},
+	},
+	{
+		Name:	"push",
+		Aliases: []string{"p"},
+		Usage:	"[options] <name> <access-type>\n" +
+		       "   uploads local versions of <name> (see commit) to remote, access-type is same as for mount\n",
+		Action: push,
+		Flags: []cli.Flag {
+			keyFlag,
+			signKeyFlag,
+		},
+	},
+	{
+		Name:	"keygen",
+		Usage:	"<key-file>\n" +
+		       "   creates a new key to sign versions with (see --signkey), prints its public key to trust\n",
+		Action: keygen,
+	},
+	{
+		Name:	"log",
+		Aliases: []string{"l"},
+		Usage:	"[options] <name> <access-type>\n" +
+		       "   shows version history of <name> in remote, latest first, access-type is same as for mount\n",
+		Action: history,
+		Flags: []cli.Flag {
+			keyFlag,
+		},
+	},
+	{
+		Name:	"info",
+		Aliases: []string{"i"},
+		Usage:	"[options] <name> <access-type> [<version>]\n" +
+		       "   shows a version of <name> in remote (latest if not given, or a tag or branch) and its root hash,\n" +
+		       "   same root hash is same files and content. access-type is same as for mount\n",
+		Action: info,
+		Flags: []cli.Flag {
+			keyFlag,
+			cli.BoolFlag {
+				Name: "json, j",
+				Usage: "Output in JSON",
+				Destination: &jsonOut,
+			},
+		},
+	},
+	{
+		Name:	"verify",
+		Aliases: []string{"v"},
+		Usage:	"[options] <name>\n" +
+		       "   checks chunks in local cache of <name>, bad chunks are removed and got again when read\n",
+		Action: verify,
+		Flags: []cli.Flag {
+			keyFlag,
+		},
 	},
 }
 
@@ -19,6 +19,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/codec"
 	"github.com/muthu-r/horcrux/revelo"
 )
 
@@ -35,12 +36,18 @@ const (
 )
 
 type Volume struct {
-	DvName     string `json:"Docker Name"`  // Docker Vol name (docker volume create --name)
-	HorName    string `json:"Horcrux Name"` // Horcrux volume name - separate from dvname
-	AccessArgs string `json:"AccessArgs"`   // Access specific args
-	mntCount   int    // Number of times mounted
-	MntDir     string `json:"Mount Dir"` // Mount dir for volume - from WORKDIR and horname
-	CacheDir   string `json:"Cache Dir"` // Cache dir
+	DvName      string `json:"Docker Name"`       // Docker Vol name (docker volume create --name)
+	HorName     string `json:"Horcrux Name"`      // Horcrux volume name - separate from dvname
+	AccessArgs  string `json:"AccessArgs"`        // Access specific args
+	KeyFile     string `json:"Key File"`          // Key for encrypted horcrux, if not in env
+	Version     string `json:"Version,omitempty"` // Version or ref (tag/branch) to mount, latest if empty
+	ReadOnly    bool   `json:"Read Only,omitempty"`
+	SignKeyFile string `json:"Sign Key File,omitempty"` // Key to sign pushed versions with, if not in env
+	TrustedKeys string `json:"Trusted Keys,omitempty"`  // File of keys versions have to be signed by
+	Verify      string `json:"Verify,omitempty"`        // revelo.VERIFY_*
+	mntCount    int    // Number of times mounted
+	MntDir      string `json:"Mount Dir"` // Mount dir for volume - from WORKDIR and horname
+	CacheDir    string `json:"Cache Dir"` // Cache dir
 }
 
 type VolumeData struct {
@@ -165,11 +172,13 @@ type Capability struct {
 }
 
 type DockerResponse struct {
-	MntPoint	string		    `json:"Mountpoint"`
-	Volume		DockerVolume	`json:"Volume"`
-	VolumeList	[]DockerVolume	`json:"Volumes"`
-	Caps        Capability      `json:"Capabilities"`
-	Err			string			`json:"Err"`
+	MntPoint   string          `json:"Mountpoint"`
+	Volume     DockerVolume    `json:"Volume"`
+	VolumeList []DockerVolume  `json:"Volumes"`
+	Caps       Capability      `json:"Capabilities"`
+	Version    string          `json:"Version,omitempty"` // Horcrux version, for Horcrux.* requests
+	Changes    []revelo.Change `json:"Changes,omitempty"` // For Horcrux.Status
+	Err        string          `json:"Err"`
 }
 
 func getDockerRequest(w http.ResponseWriter, r *http.Request) (*DockerRequest, error) {
@@ -210,7 +219,14 @@ var Handles = []DockerPluginHandles{
 	{"/VolumeDriver.Path",		PathHandler},
 	{"/VolumeDriver.Get",		GetHandler},
 	{"/VolumeDriver.List",		ListHandler},
-	{"/VolumeDriver.Capabilities",	CapHandler}}
+	{"/VolumeDriver.Capabilities",	CapHandler},
+
+	// Horcrux specific - Opts are same as horcrux-cli options
+	{"/Horcrux.Commit",		CommitHandler},
+	{"/Horcrux.Push",		PushHandler},
+	{"/Horcrux.Status",		StatusHandler},
+	{"/Horcrux.Reset",		ResetHandler},
+	{"/Horcrux.Pull",		PullHandler}}
 
 func ActivateHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", contentType)
@@ -219,6 +235,14 @@ func ActivateHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// Volume option name, given as "-o name=val" or "-o --name=val"
+func volOption(opts map[string]string, name string) string {
+	if val, ok := opts["--"+name]; ok {
+		return val
+	}
+	return opts[name]
+}
+
 func CreateHandler(req *DockerRequest) *DockerResponse {
 	var err error
 
@@ -238,7 +262,15 @@ func CreateHandler(req *DockerRequest) *DockerResponse {
 		}
 	}
 
-	v := Volume{DvName: req.Name, HorName: req.Options["--name"], AccessArgs: req.Options["--access"]}
+	v := Volume{DvName: req.Name,
+		HorName:     req.Options["--name"],
+		AccessArgs:  req.Options["--access"],
+		KeyFile:     volOption(req.Options, "keyfile"),
+		Version:     volOption(req.Options, "version"),
+		ReadOnly:    volOption(req.Options, "readonly") == "true",
+		SignKeyFile: volOption(req.Options, "signkey"),
+		TrustedKeys: volOption(req.Options, "trusted-keys"),
+		Verify:      volOption(req.Options, "verify")}
 
 	v.CacheDir, v.MntDir, err = createWorkDirs(v.DvName)
 	log.WithFields(log.Fields{"CacheDir": v.CacheDir, "MntDir": v.MntDir}).Debug("dv: Create: ")
@@ -310,8 +342,21 @@ func MountHandler(req *DockerRequest) *DockerResponse {
 	}
 
 	if v.mntCount == 0 {
+		key, err := codec.LoadKey(v.KeyFile)
+		if err != nil {
+			log.WithFields(log.Fields{"Volume": v, "Error": err}).Error("dv: Mount: Cannot get key")
+			return &DockerResponse{Err: " Volume " + v.DvName + " cannot get key: " + err.Error()}
+		}
+
+		trusted, err := codec.LoadTrustedKeys(v.TrustedKeys)
+		if err != nil {
+			log.WithFields(log.Fields{"Volume": v, "Error": err}).Error("dv: Mount: Cannot get trusted keys")
+			return &DockerResponse{Err: " Volume " + v.DvName + " cannot get trusted keys: " + err.Error()}
+		}
+
 		go func() {
-			err := revelo.Revelo(v.HorName, v.AccessArgs, v.CacheDir, v.MntDir)
+			opts := revelo.MountOpts{Version: v.Version, ReadOnly: v.ReadOnly, Verify: v.Verify, Trusted: trusted}
+			err := revelo.Revelo(v.HorName, v.AccessArgs, key, v.CacheDir, v.MntDir, opts)
 			if err != nil {
 				log.WithFields(log.Fields{"Volume": v, "Error": err}).Error("dv: Mount: Cannot mount")
 				return
@@ -418,6 +463,174 @@ func CapHandler(req *DockerRequest) *DockerResponse {
     return &DockerResponse{Caps:cap, Err:""}
 }
 
+// Commits local changes of a mounted volume
+//  - Opts: "--message" (required), "--author"
+func CommitHandler(req *DockerRequest) *DockerResponse {
+	log.WithFields(log.Fields{"Req": req}).Debug("dv: Commit Handler")
+
+	VolData.lock.RLock()
+	v, ok := VolData.Volumes[req.Name]
+	VolData.lock.RUnlock()
+
+	if !ok {
+		log.WithFields(log.Fields{"Volume": req.Name}).Error("dv: Commit: Volume not found")
+		return &DockerResponse{Err: " Volume " + req.Name + " not found"}
+	}
+
+	if v.mntCount <= 0 {
+		log.WithFields(log.Fields{"Volume": v}).Error("dv: Commit: Volume not mounted")
+		return &DockerResponse{Err: " Volume " + v.DvName + " not mounted"}
+	}
+
+	message := req.Options["--message"]
+	if message == "" {
+		return &DockerResponse{Err: " Volume " + v.DvName + " commit needs --message"}
+	}
+
+	author := req.Options["--author"]
+	if author == "" {
+		author = "horcrux-dv"
+	}
+
+	ver, err := revelo.Commit(v.MntDir, message, author)
+	if err != nil {
+		log.WithFields(log.Fields{"Volume": v, "Error": err}).Error("dv: Commit: Cannot commit")
+		return &DockerResponse{Err: " Volume " + v.DvName + " cannot commit: " + err.Error()}
+	}
+
+	log.Infof("Committed volume %v, version %v", v, ver)
+	return &DockerResponse{Version: ver, Err: ""}
+}
+
+// Pushes local versions of a volume to its remote
+func PushHandler(req *DockerRequest) *DockerResponse {
+	log.WithFields(log.Fields{"Req": req}).Debug("dv: Push Handler")
+
+	VolData.lock.RLock()
+	v, ok := VolData.Volumes[req.Name]
+	VolData.lock.RUnlock()
+
+	if !ok {
+		log.WithFields(log.Fields{"Volume": req.Name}).Error("dv: Push: Volume not found")
+		return &DockerResponse{Err: " Volume " + req.Name + " not found"}
+	}
+
+	key, err := codec.LoadKey(v.KeyFile)
+	if err != nil {
+		log.WithFields(log.Fields{"Volume": v, "Error": err}).Error("dv: Push: Cannot get key")
+		return &DockerResponse{Err: " Volume " + v.DvName + " cannot get key: " + err.Error()}
+	}
+
+	signKey, err := codec.LoadSignKey(v.SignKeyFile)
+	if err != nil {
+		log.WithFields(log.Fields{"Volume": v, "Error": err}).Error("dv: Push: Cannot get sign key")
+		return &DockerResponse{Err: " Volume " + v.DvName + " cannot get sign key: " + err.Error()}
+	}
+
+	ver, err := revelo.Push(v.HorName, v.AccessArgs, key, signKey, v.CacheDir)
+	if err != nil {
+		log.WithFields(log.Fields{"Volume": v, "Error": err}).Error("dv: Push: Cannot push")
+		return &DockerResponse{Err: " Volume " + v.DvName + " cannot push: " + err.Error()}
+	}
+
+	log.Infof("Pushed volume %v, version %v", v, ver)
+	return &DockerResponse{Version: ver, Err: ""}
+}
+
+// Local changes of a mounted volume, from its version
+func StatusHandler(req *DockerRequest) *DockerResponse {
+	log.WithFields(log.Fields{"Req": req}).Debug("dv: Status Handler")
+
+	VolData.lock.RLock()
+	v, ok := VolData.Volumes[req.Name]
+	VolData.lock.RUnlock()
+
+	if !ok {
+		log.WithFields(log.Fields{"Volume": req.Name}).Error("dv: Status: Volume not found")
+		return &DockerResponse{Err: " Volume " + req.Name + " not found"}
+	}
+
+	if v.mntCount <= 0 {
+		log.WithFields(log.Fields{"Volume": v}).Error("dv: Status: Volume not mounted")
+		return &DockerResponse{Err: " Volume " + v.DvName + " not mounted"}
+	}
+
+	changes, err := revelo.Status(v.MntDir)
+	if err != nil {
+		log.WithFields(log.Fields{"Volume": v, "Error": err}).Error("dv: Status: Cannot get status")
+		return &DockerResponse{Err: " Volume " + v.DvName + " cannot get status: " + err.Error()}
+	}
+
+	return &DockerResponse{Changes: changes, Err: ""}
+}
+
+// Drops local changes of a mounted volume
+//  - Opts: "--paths" (comma separated), or "--hard" to drop all
+func ResetHandler(req *DockerRequest) *DockerResponse {
+	log.WithFields(log.Fields{"Req": req}).Debug("dv: Reset Handler")
+
+	VolData.lock.RLock()
+	v, ok := VolData.Volumes[req.Name]
+	VolData.lock.RUnlock()
+
+	if !ok {
+		log.WithFields(log.Fields{"Volume": req.Name}).Error("dv: Reset: Volume not found")
+		return &DockerResponse{Err: " Volume " + req.Name + " not found"}
+	}
+
+	if v.mntCount <= 0 {
+		log.WithFields(log.Fields{"Volume": v}).Error("dv: Reset: Volume not mounted")
+		return &DockerResponse{Err: " Volume " + v.DvName + " not mounted"}
+	}
+
+	var paths []string
+	if p := req.Options["--paths"]; p != "" {
+		paths = strings.Split(p, ",")
+	}
+
+	if len(paths) == 0 && req.Options["--hard"] != "true" {
+		return &DockerResponse{Err: " Volume " + v.DvName + " reset needs --paths or --hard"}
+	}
+
+	changes, err := revelo.Reset(v.MntDir, paths)
+	if err != nil {
+		log.WithFields(log.Fields{"Volume": v, "Error": err}).Error("dv: Reset: Cannot reset")
+		return &DockerResponse{Err: " Volume " + v.DvName + " cannot reset: " + err.Error()}
+	}
+
+	log.Infof("Reset volume %v, %v changes dropped", v, len(changes))
+	return &DockerResponse{Changes: changes, Err: ""}
+}
+
+// Moves a mounted volume to the latest remote version, keeping local changes
+//  - On conflicts, Changes are the conflicting files
+func PullHandler(req *DockerRequest) *DockerResponse {
+	log.WithFields(log.Fields{"Req": req}).Debug("dv: Pull Handler")
+
+	VolData.lock.RLock()
+	v, ok := VolData.Volumes[req.Name]
+	VolData.lock.RUnlock()
+
+	if !ok {
+		log.WithFields(log.Fields{"Volume": req.Name}).Error("dv: Pull: Volume not found")
+		return &DockerResponse{Err: " Volume " + req.Name + " not found"}
+	}
+
+	if v.mntCount <= 0 {
+		log.WithFields(log.Fields{"Volume": v}).Error("dv: Pull: Volume not mounted")
+		return &DockerResponse{Err: " Volume " + v.DvName + " not mounted"}
+	}
+
+	ver, changes, err := revelo.Pull(v.MntDir)
+	if err != nil {
+		log.WithFields(log.Fields{"Volume": v, "Error": err}).Error("dv: Pull: Cannot pull")
+		return &DockerResponse{Changes: changes, Err: " Volume " + v.DvName + " cannot pull: " + err.Error()}
+	}
+
+	log.Infof("Pulled volume %v, version %v, %v changes", v, ver, len(changes))
+	return &DockerResponse{Version: ver, Changes: changes, Err: ""}
+}
+
 func unmountAllVols() {
 	for _, v := range VolData.Volumes {
 		if v.mntCount > 0 {
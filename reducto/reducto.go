@@ -3,92 +3,213 @@
 //  - Converts files in <in-dir> to horcrux format and puts them 
 //    in <out-dir>. <out-dir> can then be put in remote location (ex:aws s3, minio, scp, etc..) 
 //    to use with on-demand local access and version control.
+//  - Update makes the next version in <out-dir> from <in-dir>, adding
+//    only chunks that are new in it.
+//  - Each version is recorded in the meta history, with message, who
+//    made it, when and its size.
+//  - Metas are signed, if a sign key is given (see codec/sign.go)
 //
 
 package reducto
 
 import (
+	"bufio"
+	"crypto/ed25519"
 	"encoding/json"
+	"fmt"
 	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/user"
 	"path"
-	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/codec"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-// Splits a file into multiple chunks - returns number of chunks
-func split(Type int, chunkSz int, inName string, outName string) (int64, error) {
+// Stores chunk data in outPath by its hash, if not there already
+// Stored data is encoded with c, hash is of data as is
+// Returns chunk hash, and if it was a new chunk
+func storeChunk(c *codec.Codec, outPath string, data []byte) (string, bool, error) {
+	hash := c.Hash(data)
+	chunkName := outPath + "/" + horcrux.ChunkPath(hash)
+
+	if _, err := os.Stat(chunkName); err == nil {
+		// Same data in some other file or chunk
+		return hash, false, nil
+	}
+
+	if err := os.MkdirAll(path.Dir(chunkName), 0755); err != nil {
+		log.WithFields(log.Fields{"Chunk": chunkName, "Error": err}).Error("Reducto: Cannot create chunk dir")
+		return "", false, err
+	}
+
+	data, err := c.Encode(hash, data)
+	if err != nil {
+		log.WithFields(log.Fields{"Chunk": chunkName, "Error": err}).Error("Reducto: Cannot encode chunk")
+		return "", false, err
+	}
+
+	// Write to tmp and rename - we never have a partial chunk by its hash
+	tmpName := chunkName + ".tmp"
+	chunkFile, err := os.Create(tmpName)
+	if err != nil {
+		log.WithFields(log.Fields{"Chunk": tmpName, "Error": err}).Error("Reducto: Cannot create chunk file")
+		return "", false, err
+	}
+
+	n, err := chunkFile.Write(data)
+	chunkFile.Close()
+	if err != nil || n != len(data) {
+		log.WithFields(log.Fields{
+			"Chunk": tmpName,
+			"Size":  len(data),
+			"Wrote": n,
+			"Error": err,
+		}).Error("Reducto: Cannot write chunk file")
+		os.Remove(tmpName)
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		return "", false, err
+	}
+
+	if err := os.Rename(tmpName, chunkName); err != nil {
+		log.WithFields(log.Fields{"Chunk": chunkName, "Error": err}).Error("Reducto: Cannot rename chunk file")
+		os.Remove(tmpName)
+		return "", false, err
+	}
+
+	return hash, true, nil
+}
+
+// Splits a file into multiple chunks and stores them in outPath
+// Returns start offset and hash of each chunk
+//  - CHUNK_TYPE_STATIC: fixed cfg.ChunkSize chunks
+//  - CHUNK_TYPE_ROLLSUM: content defined chunks, see rollsum.go
+func split(cfg horcrux.Config, c *codec.Codec, inName string, outPath string) ([]int64, []string, error) {
 	inFile, err := os.OpenFile(inName, os.O_RDONLY, 0)
 	if err != nil {
 		log.Errorf("Reducto: split - cannot open file %v, err: %v", inName, err)
-		return 0, err
+		return nil, nil, err
 	}
 	defer inFile.Close()
 
 	fi, err := inFile.Stat()
 	if err != nil {
 		log.Errorf("Reducto: Cannot stat file %v, err: %v", inName, err)
-		return 0, err
+		return nil, nil, err
 	}
 
-	numChunks := (fi.Size() + int64(chunkSz) - 1) / int64(chunkSz)
+	log.WithFields(log.Fields{"File": inName, "Size": fi.Size(), "Type": cfg.ChunkType}).Debug("Reducto: splitting")
 
-	log.WithFields(log.Fields{"File": inName, "Size": fi.Size(), "NumChunks": numChunks}).Debug("Reducto: splitting")
+	var data []byte
+	var rs *rollsum
+	switch cfg.ChunkType {
+	case horcrux.CHUNK_TYPE_STATIC:
+		data = make([]byte, cfg.ChunkSize)
+	case horcrux.CHUNK_TYPE_ROLLSUM:
+		data = make([]byte, cfg.MaxChunkSize)
+		rs = newRollsum(cfg)
+	default:
+		log.Errorf("Reducto: split - unknown chunk type %v", cfg.ChunkType)
+		return nil, nil, syscall.EINVAL
+	}
 
-	data := make([]byte, chunkSz)
-	for chunkIdx := int64(0); chunkIdx < numChunks; chunkIdx++ {
-		chunkName := outName + "." + strconv.FormatInt(chunkIdx, 10)
-		// TODO: See if we can pipe (or splice :))
-		n, err := inFile.Read(data)
+	// TODO: See if we can pipe (or splice :))
+	rd := bufio.NewReaderSize(inFile, 1<<20)
+	chunkOffs := []int64{}
+	chunks := []string{}
+	newChunks := 0
+	off := int64(0)
+	for chunkIdx := int64(0); ; chunkIdx++ {
+		var n int
+		if rs != nil {
+			n, err = rs.next(rd, data)
+		} else {
+			n, err = io.ReadFull(rd, data)
+			if err == io.ErrUnexpectedEOF {
+				err = nil // Last chunk
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
 			log.WithFields(log.Fields{
 				"In File":  inName,
-				"Chunk":    chunkName,
 				"chunkIdx": chunkIdx,
 				"Error":    err,
 			}).Error("Reducto: split - read failed")
-			return 0, err
-		}
-
-		if n == 0 {
-			// TODO : Can this happen? And is it error?
-			continue
+			return nil, nil, err
 		}
-		data = data[:n]
 
-		chunkFile, err := os.Create(chunkName)
+		hash, isNew, err := storeChunk(c, outPath, data[:n])
 		if err != nil {
 			log.WithFields(log.Fields{"In File": inName,
 				"Chunk Index": chunkIdx,
-				"Chunk Name":  chunkName,
 				"Error":       err,
-			}).Error("Reducto: split - cannot create chunk file")
-			return 0, err
+			}).Error("Reducto: split - cannot store chunk")
+			return nil, nil, err
+		}
+		if isNew {
+			newChunks++
 		}
 
-		n2, err := chunkFile.Write(data)
-		chunkFile.Close()
+		chunkOffs = append(chunkOffs, off)
+		chunks = append(chunks, hash)
+		off += int64(n)
+	}
 
-		if err != nil || n2 != n {
-			log.WithFields(log.Fields{"File": inName,
-				"Chunk":     chunkName,
-				"Chunk Idx": chunkIdx,
-				"n":         n,
-				"n2":        n2,
-				"Error":     err,
-			}).Error("Reducto: read (n), wrote (n2): Failed")
-			return 0, err
+	log.WithFields(log.Fields{
+		"File":       inName,
+		"Size":       off,
+		"NumChunks":  len(chunkOffs),
+		"New Chunks": newChunks,
+	}).Debug("Reducto: split done")
+	return chunkOffs, chunks, nil
+}
+
+// Chunking config for Type with chunkSz (average size for rollsum)
+// Chunks are encoded with Codec, and encrypted if key is given
+func chunkConfig(Type int, chunkSz int, Codec string, key []byte) (horcrux.Config, error) {
+	Config := horcrux.Config{Version: horcrux.VERSION, ChunkType: Type, ChunkSize: chunkSz, Codec: Codec}
+
+	if !codec.Valid(Codec) {
+		log.Errorf("Reducto: unknown codec %v", Codec)
+		return Config, syscall.EINVAL
+	}
+
+	if len(key) != 0 {
+		Config.Encryption = horcrux.ENCRYPT_AESGCM
+		Config.KeyId = codec.KeyId(key)
+	}
+
+	switch Type {
+	case horcrux.CHUNK_TYPE_STATIC:
+	case horcrux.CHUNK_TYPE_ROLLSUM:
+		if chunkSz&(chunkSz-1) != 0 {
+			log.Errorf("Reducto: rollsum average chunk size %v not a power of 2", chunkSz)
+			return Config, syscall.EINVAL
 		}
+		Config.MinChunkSize = chunkSz / horcrux.ROLLSUM_MIN_DIV
+		Config.MaxChunkSize = chunkSz * horcrux.ROLLSUM_MAX_MUL
+	default:
+		log.Errorf("Reducto: unknown chunk type %v", Type)
+		return Config, syscall.EINVAL
 	}
 
-	return numChunks, nil
+	return Config, nil
 }
 
-func Reducto(Type int, chunkSz int, Name, inPath string, outPath string) error {
+func Reducto(Type int, chunkSz int, Codec string, key []byte, signKey ed25519.PrivateKey, Message string, Name, inPath string, outPath string) error {
 	inPath = path.Clean(inPath)
 	outPath = path.Clean(outPath)
 
@@ -96,22 +217,27 @@ func Reducto(Type int, chunkSz int, Name, inPath string, outPath string) error {
 		"Version":  horcrux.VERSION,
 		"Type":     Type,
 		"Chunk Size": chunkSz,
+		"Codec":    Codec,
+		"Encrypt":  len(key) != 0,
+		"Sign":     len(signKey) != 0,
 		"In File":  inPath,
 		"Out File": outPath,
 	}).Debug("Reducto")
 
-	stat, err := getStat(inPath)
+	Config, err := chunkConfig(Type, chunkSz, Codec, key)
 	if err != nil {
-		log.WithFields(log.Fields{"In File": inPath, "Error": err}).Error("Reducto: Cannot stat in path")
 		return err
 	}
 
-	if stat.Mode.IsDir() == false {
-		log.Errorf("Reducto: input %v has to be a directory", inPath)
-		return syscall.EINVAL
+	c, err := codec.New(Config, key)
+	if err != nil {
+		return err
 	}
 
-	perm := stat.Mode.Perm()
+	stat, err := inStat(inPath)
+	if err != nil {
+		return err
+	}
 
 	if _, err := os.Stat(outPath); err == nil {
 		// Any other err captured later
@@ -119,27 +245,181 @@ func Reducto(Type int, chunkSz int, Name, inPath string, outPath string) error {
 		return syscall.EEXIST
 	}
 
-	os.MkdirAll(outPath, perm)
+	os.MkdirAll(outPath, stat.Mode.Perm())
 
-	metaFile, err := os.Create(outPath + "/" + Name + ".meta")
+	Meta := &horcrux.Meta{Config: Config, CurrVer: horcrux.VerName(horcrux.STARTVER)}
+	var links map[int]int
+	Meta.Entries, links, err = walk(Config, c, nil, inPath, outPath)
+	if err != nil {
+		return err
+	}
+	Meta.NumFiles = len(Meta.Entries)
+	horcrux.SetInodes(Meta, nil)
+	setLinks(Meta, links)
+
+	if Message == "" {
+		Message = "generate from " + inPath
+	}
+	Meta.History = []horcrux.Version{newVersion(Meta, "", Message, nil)}
+
+	return writeMeta(Meta, key, signKey, Name, outPath)
+}
+
+// Update generates the next version of horcrux Name in outPath from inPath
+//  - Chunking and codec are same as the latest version
+//  - Files with same size and mtime as in the latest version reuse its chunks,
+//    others are split again and only chunks not already in outPath are added
+func Update(key []byte, signKey ed25519.PrivateKey, Message string, Name, inPath string, outPath string) error {
+	inPath = path.Clean(inPath)
+	outPath = path.Clean(outPath)
+
+	prev, err := readMeta(key, outPath+"/"+Name+".meta")
+	if err != nil {
+		return err
+	}
+
+	prevVer, err := horcrux.VerNum(prev.CurrVer)
+	if err != nil {
+		log.WithFields(log.Fields{"Version": prev.CurrVer, "Error": err}).Error("Reducto: Invalid current version")
+		return syscall.EINVAL
+	}
+
+	if prevVer >= horcrux.MAXVER {
+		log.Errorf("Reducto: Already at max version %v", horcrux.MAXVER)
+		return syscall.ENOSPC
+	}
+
+	log.WithFields(log.Fields{
+		"Version":      horcrux.VERSION,
+		"Prev Version": prev.CurrVer,
+		"In File":      inPath,
+		"Out File":     outPath,
+	}).Debug("Reducto: Update")
+
+	// Fails for wrong or missing key
+	c, err := codec.New(prev.Config, key)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"Meta File": outPath + "/" + Name + ".meta",
-			"Error":     err,
-		}).Error("Reducto: Cannot create Meta file")
 		return err
 	}
-	defer metaFile.Close()
 
-	currVer := "v" + strconv.Itoa(horcrux.STARTVER)
+	if _, err := inStat(inPath); err != nil {
+		return err
+	}
+
+	prevFiles := make(map[string]*horcrux.Entry)
+	for i := range prev.Entries {
+		e := &prev.Entries[i]
+		if !e.IsDir {
+			prevFiles[relName(e.Prefix, e.Name)] = e
+		}
+	}
+
+	Meta := &horcrux.Meta{Config: prev.Config, CurrVer: horcrux.VerName(prevVer + 1)}
+	var links map[int]int
+	Meta.Entries, links, err = walk(prev.Config, c, prevFiles, inPath, outPath)
+	if err != nil {
+		return err
+	}
+	Meta.NumFiles = len(Meta.Entries)
+
+	// Files and dirs still there keep their inodes
+	horcrux.SetInodes(Meta, prev)
+	setLinks(Meta, links)
+
+	if Message == "" {
+		Message = "update from " + inPath
+	}
+	Meta.History = append(prevHistory(prev), newVersion(Meta, prev.CurrVer, Message, horcrux.ChunkSet(prev)))
+
+	return writeMeta(Meta, key, signKey, Name, outPath)
+}
+
+// History of prev to add the next version to - horcrux made before
+// history was kept has a bare record of its version
+func prevHistory(prev *horcrux.Meta) []horcrux.Version {
+	if prev.Version() != nil {
+		return prev.History
+	}
+	return append(prev.History, horcrux.Version{Name: prev.CurrVer})
+}
+
+// Record of version in Meta, made now by current user
+func newVersion(Meta *horcrux.Meta, parent string, message string, parentChunks map[string]bool) horcrux.Version {
+	ver := horcrux.Version{
+		Name:    Meta.CurrVer,
+		Parent:  parent,
+		Message: message,
+		Time:    time.Now().Unix(),
+	}
+
+	if u, err := user.Current(); err == nil {
+		ver.Author = u.Username
+	}
+
+	horcrux.VersionStats(&ver, Meta, parentChunks)
+	return ver
+}
+
+// Stat of inPath - has to be a directory
+func inStat(inPath string) (horcrux.Stat, error) {
+	stat, _, err := getStat(inPath, true)
+	if err != nil {
+		log.WithFields(log.Fields{"In File": inPath, "Error": err}).Error("Reducto: Cannot stat in path")
+		return stat, err
+	}
+
+	if stat.Mode.IsDir() == false {
+		log.Errorf("Reducto: input %v has to be a directory", inPath)
+		return stat, syscall.EINVAL
+	}
+
+	return stat, nil
+}
+
+// Path of entry relative to the horcrux root - root dir name can change across versions
+func relName(prefix string, name string) string {
+	i := strings.Index(prefix, "/")
+	if i < 0 {
+		return name
+	}
+	return prefix[i+1:] + "/" + name
+}
+
+// Is file with stat same as prev entry - its chunks can be used as is
+func unchanged(prev *horcrux.Entry, stat horcrux.Stat) bool {
+	return prev != nil &&
+		prev.Stat.Mtime != 0 &&
+		prev.Stat.Mtime == stat.Mtime &&
+		prev.Stat.Size == stat.Size &&
+		prev.Stat.Mode == stat.Mode &&
+		!prev.HardLink &&
+		len(prev.Chunks) == len(prev.ChunkOffs)
+}
+
+// Makes entries in links (index of a hard link -> index of the entry with
+// its data) hard links, with the inode of their file
+func setLinks(Meta *horcrux.Meta, links map[int]int) {
+	for l, f := range links {
+		Meta.Entries[l].HardLink = true
+		Meta.Entries[l].Ino = Meta.Entries[f].Ino
+	}
+}
+
+// Walks inPath and returns meta entries of all dirs and files in it
+// Files unchanged from prevFiles (by relName) reuse their chunks, others
+// are split to chunks in outPath
+// Hard links of a file seen before have no chunks - returned in links, by
+// index of the link and of the file (see setLinks)
+func walk(Config horcrux.Config, c *codec.Codec, prevFiles map[string]*horcrux.Entry, inPath string, outPath string) ([]horcrux.Entry, map[int]int, error) {
+	// inPath itself can be a symlink to the data
+	stat, _, err := getStat(inPath, true)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	outPath = outPath + "/" + currVer
 	inBase := path.Base(inPath)
 	inDir := path.Dir(inPath)
-	os.MkdirAll(outPath+"/"+inBase, perm)
 
-	Config := horcrux.Config{Version: horcrux.VERSION, ChunkType: Type, ChunkSize: chunkSz}
-	Meta := &horcrux.Meta{Config: Config, CurrVer: currVer}
 	prefix := ""
 
 	root := horcrux.Entry{Name: inBase,
@@ -148,7 +428,11 @@ func Reducto(Type int, chunkSz int, Name, inPath string, outPath string) error {
 		Stat:      stat,
 		NumChunks: 1}
 	EntryList := []horcrux.Entry{root}
-	numFiles := 1	// for root
+	reused := 0
+
+	// Index of the first entry of each source inode with links
+	seenLinks := make(map[string]int)
+	links := make(map[int]int)
 
 	dirList := []string{inBase}
 
@@ -162,7 +446,7 @@ func Reducto(Type int, chunkSz int, Name, inPath string, outPath string) error {
 				"Dir":    inDir + "/" + dir,
 				"Error":  err,
 			}).Error("Reducto: Cannot Open")
-			return err
+			return nil, nil, err
 		}
 
 		log.WithFields(log.Fields{
@@ -177,7 +461,7 @@ func Reducto(Type int, chunkSz int, Name, inPath string, outPath string) error {
 				"Dir":   inDir + "/" + dir,
 				"Error": err,
 			}).Error("Reducto: Cannot Readdirname")
-			return err
+			return nil, nil, err
 
 		}
 
@@ -186,50 +470,118 @@ func Reducto(Type int, chunkSz int, Name, inPath string, outPath string) error {
 			path := inDir + "/" + dir + "/" + ent
 			dirEnts = dirEnts[1:]
 
-			stat, err := getStat(path)
+			stat, linkID, err := getStat(path, false)
 			if err != nil {
 				log.WithFields(log.Fields{
 					"Dir":   path,
 					"Error": err,
 				}).Error("Reducto: Cannot get stat")
-				return err
+				return nil, nil, err
+			}
+
+			if f, ok := seenLinks[linkID]; ok && linkID != "" {
+				links[len(EntryList)] = f
+				EntryList = append(EntryList, horcrux.Entry{Name: ent,
+						Prefix:    dir,
+						Stat:      stat})
+				continue
+			} else if linkID != "" {
+				seenLinks[linkID] = len(EntryList)
 			}
 
 			isDir := stat.Mode.IsDir()
 
 			var numChunks int64
+			var chunkOffs []int64
+			var chunks []string
+			var target string
 			if isDir {
-				perm := stat.Mode.Perm()
-				err := os.Mkdir(outPath+"/"+dir+"/"+ent, perm)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"Dir":   outPath + "/" + dir + "/" + ent,
-						"Perm":  perm,
-						"Error": err,
-					}).Error("Reducto: Cannot Mkdir")
-					return err
-				}
 				dirList = append(dirList, dir+"/"+ent)
 				numChunks = 1	//XXX Should we make this 0?
+			} else if stat.Mode&os.ModeSymlink != 0 {
+				// Kept as is, not followed - target may not be in the data
+				target, err = os.Readlink(path)
+				if err != nil {
+					log.WithFields(log.Fields{"Link": path, "Error": err}).Error("Reducto: Cannot read link")
+					return nil, nil, err
+				}
+			} else if prev := prevFiles[relName(dir, ent)]; unchanged(prev, stat) {
+				chunkOffs = prev.ChunkOffs
+				chunks = prev.Chunks
+				numChunks = int64(len(chunkOffs))
+				reused++
 			} else {
-				numChunks, err = split(Type, chunkSz, path, outPath+"/"+dir+"/"+ent)
+				chunkOffs, chunks, err = split(Config, c, path, outPath)
 				if err != nil {
-					log.Errorf("Split: Error splitting %v, err %v", outPath+"/"+dir+"/"+ent, err)
-					return err
+					log.Errorf("Split: Error splitting %v, err %v", path, err)
+					return nil, nil, err
 				}
+				numChunks = int64(len(chunkOffs))
 			}
 
 			EntryList = append(EntryList, horcrux.Entry{Name: ent,
 						Prefix:    dir,
 						IsDir:     isDir,
 						Stat:      stat,
-						NumChunks: numChunks})
-			numFiles += 1
+						NumChunks: numChunks,
+						ChunkOffs: chunkOffs,
+						Chunks:    chunks,
+						Target:    target})
 		}
 	}
 
-	Meta.NumFiles = numFiles
-	Meta.Entries = EntryList
+	log.WithFields(log.Fields{
+		"In Path":         inPath,
+		"Entries":         len(EntryList),
+		"Unchanged Files": reused,
+		"Hard Links":      len(links),
+	}).Debug("Reducto: walk done")
+	return EntryList, links, nil
+}
+
+// Reads meta from file - decrypted with key, if its encrypted
+func readMeta(key []byte, name string) (*horcrux.Meta, error) {
+	js, err := ioutil.ReadFile(name)
+	if err != nil {
+		log.WithFields(log.Fields{"Meta File": name, "Error": err}).Error("Reducto: Cannot read meta file")
+		return nil, err
+	}
+
+	js, err = codec.OpenMeta(key, js)
+	if err != nil {
+		log.WithFields(log.Fields{"Meta File": name, "Error": err}).Error("Reducto: Cannot decrypt meta file")
+		return nil, err
+	}
+
+	Meta := new(horcrux.Meta)
+	if err := json.Unmarshal(js, Meta); err != nil {
+		log.WithFields(log.Fields{"Meta File": name, "Error": err}).Error("Reducto: Cannot unmarshal meta file")
+		return nil, err
+	}
+
+	if err := horcrux.CheckRoot(Meta, true); err != nil {
+		log.WithFields(log.Fields{"Meta File": name, "Root Hash": Meta.Root}).Error("Reducto: Meta does not match its root hash")
+		return nil, err
+	}
+
+	return Meta, nil
+}
+
+// Writes Meta of its CurrVer to outPath, and makes it the latest
+// version - signed with signKey and encrypted with key, if given
+func writeMeta(Meta *horcrux.Meta, key []byte, signKey ed25519.PrivateKey, Name string, outPath string) error {
+	// Signed with the rest
+	Meta.Root = horcrux.RootHash(Meta)
+	if ver := Meta.Version(); ver != nil {
+		ver.Root = Meta.Root
+	}
+
+	if len(signKey) != 0 {
+		if err := codec.SignMeta(signKey, Meta); err != nil {
+			log.Errorf("Reducto: Cannot sign metadata, err = %v", err)
+			return err
+		}
+	}
 
 	js, err := json.MarshalIndent(Meta, "", "    ")
 	if err != nil {
@@ -237,30 +589,71 @@ func Reducto(Type int, chunkSz int, Name, inPath string, outPath string) error {
 		return err
 	}
 
-	n, err := metaFile.Write(js)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"Meta file": outPath + Name + ".meta",
-			"Wrote":     n, "Size": len(js),
-			"Error": err,
-		}).Error("Reducto: Cannot write to meta file")
+	if len(key) != 0 {
+		js, err = codec.SealMeta(key, js)
+		if err != nil {
+			log.Errorf("Reducto: Cannot encrypt metadata, err = %v", err)
+			return err
+		}
+	}
+
+	verName := outPath + "/" + horcrux.VerMetaPath(Meta.CurrVer, Name)
+	if err := os.MkdirAll(path.Dir(verName), 0755); err != nil {
+		log.WithFields(log.Fields{"Meta File": verName, "Error": err}).Error("Reducto: Cannot create version dir")
 		return err
 	}
 
+	// Latest meta is written last - a failed generate leaves the previous version as latest
+	for _, metaName := range []string{verName, outPath + "/" + Name + ".meta"} {
+		if err := ioutil.WriteFile(metaName+".tmp", js, 0644); err != nil {
+			log.WithFields(log.Fields{
+				"Meta file": metaName,
+				"Size":      len(js),
+				"Error":     err,
+			}).Error("Reducto: Cannot write to meta file")
+			os.Remove(metaName + ".tmp")
+			return err
+		}
+
+		if err := os.Rename(metaName+".tmp", metaName); err != nil {
+			log.WithFields(log.Fields{"Meta file": metaName, "Error": err}).Error("Reducto: Cannot rename meta file")
+			os.Remove(metaName + ".tmp")
+			return err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"Name":    Name,
+		"Version": Meta.CurrVer,
+		"Files":   Meta.NumFiles,
+	}).Info("Reducto: Generated version")
 	return nil
 }
 
-func getStat(name string) (horcrux.Stat, error) {
+// Stat of name - of the symlink itself, unless follow is set
+// Files with hard links get an id of their inode, "" for others
+func getStat(name string, follow bool) (horcrux.Stat, string, error) {
 	ustat := new(unix.Stat_t)
-	err := unix.Stat(name, ustat)
+	var err error
+	if follow {
+		err = unix.Stat(name, ustat)
+	} else {
+		err = unix.Lstat(name, ustat)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{"File": name, "Stat": ustat, "Error": err}).Error("Reducto: getStat -  unix.Stat failed")
-		return horcrux.Stat{}, err
+		return horcrux.Stat{}, "", err
 	}
 
 	mode := fileMode(ustat.Mode)
-	stat := horcrux.Stat{Mode: mode, Uid: ustat.Uid, Gid: ustat.Gid, Size: ustat.Size}
-	return stat, nil
+	stat := horcrux.Stat{Mode: mode, Uid: ustat.Uid, Gid: ustat.Gid, Size: ustat.Size,
+		Atime: ustat.Atim.Nano(), Mtime: ustat.Mtim.Nano(), Ctime: ustat.Ctim.Nano()}
+
+	var linkID string
+	if !mode.IsDir() && ustat.Nlink > 1 {
+		linkID = fmt.Sprintf("%d:%d", ustat.Dev, ustat.Ino)
+	}
+	return stat, linkID, nil
 }
 
 // TODO: Give credit to bazil.org/fuse or whoever wrote this originally
@@ -0,0 +1,110 @@
+//
+// Rolling checksum (buzhash) for content defined chunking
+//  - A chunk ends where the low bits of the hash over the last
+//    ROLLSUM_WINDOW bytes are all zero, so chunk boundaries depend
+//    only on the data around them and not on their offset in the file.
+//    Inserting a few bytes near the start of a file only changes the
+//    chunks around the insert.
+//
+
+package reducto
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/muthu-r/horcrux"
+)
+
+// Byte -> random value table for buzhash.
+// NOTE: Changing the seed or generator changes every chunk boundary,
+// so chunks from older horcruxes will no longer match.
+var rollTable [256]uint32
+
+func init() {
+	seed := uint64(0x686f726372757821) // "horcrux!"
+	for i := range rollTable {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		z = z ^ (z >> 31)
+		rollTable[i] = uint32(z)
+	}
+}
+
+func rotl(v uint32, n uint) uint32 {
+	n &= 31
+	return (v << n) | (v >> (32 - n))
+}
+
+type rollsum struct {
+	window [horcrux.ROLLSUM_WINDOW]byte
+	idx    int
+	full   bool
+	hash   uint32
+
+	min  int
+	max  int
+	mask uint32
+}
+
+func newRollsum(cfg horcrux.Config) *rollsum {
+	return &rollsum{
+		min:  cfg.MinChunkSize,
+		max:  cfg.MaxChunkSize,
+		mask: uint32(cfg.ChunkSize - 1), // ChunkSize (average) is a power of 2
+	}
+}
+
+func (rs *rollsum) reset() {
+	rs.window = [horcrux.ROLLSUM_WINDOW]byte{}
+	rs.idx = 0
+	rs.full = false
+	rs.hash = 0
+}
+
+func (rs *rollsum) roll(c byte) {
+	out := rs.window[rs.idx]
+	rs.window[rs.idx] = c
+
+	rs.hash = rotl(rs.hash, 1) ^ rollTable[c]
+	if rs.full {
+		// Drop the byte leaving the window
+		rs.hash ^= rotl(rollTable[out], horcrux.ROLLSUM_WINDOW)
+	}
+
+	rs.idx++
+	if rs.idx == horcrux.ROLLSUM_WINDOW {
+		rs.idx = 0
+		rs.full = true
+	}
+}
+
+// Reads the next chunk from r into buf (at least rs.max bytes) - returns chunk length.
+// Returns io.EOF only when there is no more data.
+func (rs *rollsum) next(r *bufio.Reader, buf []byte) (int, error) {
+	rs.reset()
+
+	n := 0
+	for n < rs.max {
+		c, err := r.ReadByte()
+		if err == io.EOF && n > 0 {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		buf[n] = c
+		n++
+		rs.roll(c)
+
+		if n >= rs.min && (rs.hash&rs.mask) == 0 {
+			break
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,77 @@
+package reducto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/muthu-r/horcrux"
+)
+
+var rollCfg = horcrux.Config{ChunkType: horcrux.CHUNK_TYPE_ROLLSUM, ChunkSize: 4096, MinChunkSize: 1024, MaxChunkSize: 16384}
+
+// Splits data with rollsum - chunks have to add up to data
+func rollChunks(t *testing.T, data []byte) []string {
+	rs := newRollsum(rollCfg)
+	rd := bufio.NewReader(bytes.NewReader(data))
+	buf := make([]byte, rollCfg.MaxChunkSize)
+
+	var chunks []string
+	var joined []byte
+	for {
+		n, err := rs.next(rd, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, string(buf[:n]))
+		joined = append(joined, buf[:n]...)
+	}
+
+	if !bytes.Equal(joined, data) {
+		t.Fatal("chunks do not add up to the data")
+	}
+	return chunks
+}
+
+func TestRollsumSizes(t *testing.T) {
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := rollChunks(t, data)
+	for i, chunk := range chunks {
+		if len(chunk) > rollCfg.MaxChunkSize || (len(chunk) < rollCfg.MinChunkSize && i != len(chunks)-1) {
+			t.Errorf("chunk %v is %v bytes", i, len(chunk))
+		}
+	}
+}
+
+func TestRollsumInsert(t *testing.T) {
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	orig := rollChunks(t, data)
+
+	for _, off := range []int{0, 100 << 10, len(data) - 10} {
+		changed := append(append(append([]byte(nil), data[:off]...), "inserted"...), data[off:]...)
+
+		have := make(map[string]bool)
+		for _, chunk := range rollChunks(t, changed) {
+			have[chunk] = true
+		}
+
+		// Only the chunk with the insert, and maybe the next one
+		missing := 0
+		for _, chunk := range orig {
+			if !have[chunk] {
+				missing++
+			}
+		}
+		if missing > 2 {
+			t.Errorf("insert at %v: %v of %v chunks changed", off, missing, len(orig))
+		}
+	}
+}
@@ -0,0 +1,302 @@
+//
+// Commit - freezes the working state of a mount into a local version
+//  - Dirty chunks are hashed and copied to the local chunk store
+//    (same as clean chunks got from remote), so the version has only
+//    hashes and does not change with later writes
+//  - Version meta goes to CACHE_COMMITDIR/<ver>/<name>.meta, with who
+//    committed it, when and why added to its history (horcrux.Version)
+//  - Working state is left as is, only its version (and base, see
+//    status.go) moves to the new one
+//
+
+package revelo
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/revelo/dirTree"
+)
+
+// Version names come after the mounted one - of a pinned version they can
+// be versions already in remote
+var ErrPinned = errors.New("mounted a version, not the latest - cannot commit")
+
+// Commits the working state of horcrux mounted at mntDir
+// Returns the new version
+func Commit(mntDir string, message string, author string) (string, error) {
+	data, err := getMount(mntDir)
+	if err != nil {
+		return "", err
+	}
+
+	return commit(data, message, author)
+}
+
+func commit(data *ReveloData, message string, author string) (string, error) {
+	if data.readOnly {
+		return "", syscall.EROFS
+	}
+
+	if data.pinned {
+		log.WithFields(log.Fields{"Version": data.CurrVer}).Error("Commit: Mounted a version, not the latest")
+		return "", ErrPinned
+	}
+
+	// No writes till we are done
+	data.commitLock.Lock()
+	defer data.commitLock.Unlock()
+
+	data.lock.RLock()
+	Meta, err := dirTree.GetMeta(data.Root)
+	parent := data.CurrVer
+	data.lock.RUnlock()
+
+	if err != nil {
+		log.Error("Commit: Cannot get Meta data")
+		return "", err
+	}
+
+	verNum, err := horcrux.VerNum(parent)
+	if err != nil {
+		log.WithFields(log.Fields{"Version": parent, "Error": err}).Error("Commit: Invalid current version")
+		return "", syscall.EINVAL
+	}
+
+	if verNum >= horcrux.MAXVER {
+		log.Errorf("Commit: Already at max version %v", horcrux.MAXVER)
+		return "", syscall.ENOSPC
+	}
+
+	ver := horcrux.VerName(verNum + 1)
+
+	// Clean chunks are all from parent
+	parentChunks := horcrux.ChunkSet(Meta)
+
+	frozen := 0
+	for i := range Meta.Entries {
+		entry := &Meta.Entries[i]
+		if entry.IsDir {
+			continue
+		}
+
+		var chunks []string
+		for idx, hash := range entry.Chunks {
+			if hash != "" {
+				continue
+			}
+
+			if chunks == nil {
+				// Shared with the tree
+				chunks = append([]string(nil), entry.Chunks...)
+			}
+
+			chunks[idx], err = freezeChunk(data, entry, int64(idx))
+			if err != nil {
+				return "", err
+			}
+			frozen++
+		}
+
+		if chunks != nil {
+			entry.Chunks = chunks
+		}
+	}
+
+	rec := horcrux.Version{
+		Name:    ver,
+		Parent:  parent,
+		Message: message,
+		Author:  author,
+		Time:    time.Now().Unix(),
+	}
+	horcrux.VersionStats(&rec, Meta, parentChunks)
+
+	Meta.Config = data.Config
+	Meta.CurrVer = ver
+	Meta.History = append(append([]horcrux.Version(nil), data.History...), rec)
+	Meta.Root = horcrux.RootHash(Meta)
+	Meta.Version().Root = Meta.Root
+
+	if err := writeVersion(data, Meta); err != nil {
+		return "", err
+	}
+
+	data.lock.Lock()
+	data.CurrVer = ver
+	data.History = Meta.History
+	data.lock.Unlock()
+
+	if err := saveMeta(data); err != nil {
+		return "", err
+	}
+
+	// Changes are from the new version now
+	if err := writeBase(data, Meta); err != nil {
+		return "", err
+	}
+
+	log.WithFields(log.Fields{
+		"Version":       ver,
+		"Parent":        parent,
+		"Frozen Chunks": frozen,
+	}).Info("Commit: Done")
+	return ver, nil
+}
+
+// Path of entry below the horcrux root
+func entryPath(entry *horcrux.Entry) string {
+	i := strings.Index(entry.Prefix, "/")
+	if i < 0 {
+		return entry.Name
+	}
+	return entry.Prefix[i+1:] + "/" + entry.Name
+}
+
+// Local name of a modified chunk of entry - same as dirtyChunkName
+func entryDirtyName(data *ReveloData, entry *horcrux.Entry, chunkIdx int64) string {
+	return entryCacheName(data, entry) + "." + strconv.FormatInt(chunkIdx, 10)
+}
+
+// Local name of entry - its dirty chunks are <name>.<idx>, as cacheName of FILE
+func entryCacheName(data *ReveloData, entry *horcrux.Entry) string {
+	return data.workDir + "/" + CACHE_DIRTYDIR + "/" + entryPath(entry)
+}
+
+// Copies dirty chunk chunkIdx of entry to the local chunk store
+// Returns its hash
+func freezeChunk(data *ReveloData, entry *horcrux.Entry, chunkIdx int64) (string, error) {
+	buf, err := readDirtyChunk(data, entry, chunkIdx)
+	if err != nil {
+		return "", err
+	}
+
+	hash := data.codec.Hash(buf)
+	cacheName := data.cacheDir + "/" + horcrux.ChunkPath(hash)
+	if _, err := os.Stat(cacheName); err == nil {
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(path.Dir(cacheName), 0700); err != nil {
+		log.WithFields(log.Fields{"cacheName": cacheName, "Error": err}).Error("Commit: Cannot MkdirAll")
+		return "", err
+	}
+
+	// Chunk in cache by its hash is always complete
+	tmpName := cacheName + ".commit"
+	if err := ioutil.WriteFile(tmpName, buf, 0600); err != nil {
+		log.WithFields(log.Fields{"cacheName": tmpName, "Error": err}).Error("Commit: Cannot write chunk")
+		os.Remove(tmpName)
+		return "", err
+	}
+
+	if err := os.Rename(tmpName, cacheName); err != nil {
+		log.WithFields(log.Fields{"cacheName": cacheName, "Error": err}).Error("Commit: Cannot rename chunk")
+		os.Remove(tmpName)
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// Data of dirty chunk chunkIdx of entry, as it is in the file
+func readDirtyChunk(data *ReveloData, entry *horcrux.Entry, chunkIdx int64) ([]byte, error) {
+	dirtyName := entryDirtyName(data, entry, chunkIdx)
+
+	dirtyFile, err := os.Open(dirtyName)
+	if err != nil {
+		log.WithFields(log.Fields{"DirtyName": dirtyName, "Error": err}).Error("Revelo: Cannot open dirty chunk")
+		return nil, err
+	}
+	defer dirtyFile.Close()
+
+	// Dirty chunk can be longer if file was truncated
+	buf, err := ioutil.ReadAll(io.LimitReader(dirtyFile, chunkLen(data.Config, entry, chunkIdx)))
+	if err != nil {
+		log.WithFields(log.Fields{"DirtyName": dirtyName, "Error": err}).Error("Revelo: Cannot read dirty chunk")
+		return nil, err
+	}
+
+	// Sparse writes leave the chunk short
+	if n := chunkLen(data.Config, entry, chunkIdx); int64(len(buf)) < n {
+		buf = append(buf, make([]byte, n-int64(len(buf)))...)
+	}
+
+	return buf, nil
+}
+
+// Local name of the meta of version ver of horcrux name
+func versionName(cacheDir string, name string, ver string) string {
+	return cacheDir + "/" + CACHE_COMMITDIR + "/" + horcrux.VerMetaPath(ver, name)
+}
+
+// Local versions of horcrux name in cacheDir, oldest first
+func localVersions(cacheDir string, name string) ([]*horcrux.Meta, error) {
+	names, _ := filepath.Glob(versionName(cacheDir, name, "v*"))
+
+	var metas []*horcrux.Meta
+	for _, verName := range names {
+		Meta, err := readMeta(verName, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := horcrux.VerNum(Meta.CurrVer); err != nil || Meta.Version() == nil {
+			log.WithFields(log.Fields{"Meta File": verName}).Error("Revelo: Invalid local version")
+			return nil, syscall.EINVAL
+		}
+		metas = append(metas, Meta)
+	}
+
+	sort.Slice(metas, func(i, j int) bool {
+		vi, _ := horcrux.VerNum(metas[i].CurrVer)
+		vj, _ := horcrux.VerNum(metas[j].CurrVer)
+		return vi < vj
+	})
+	return metas, nil
+}
+
+// Saves meta of a local version - its never changed after
+func writeVersion(data *ReveloData, Meta *horcrux.Meta) error {
+	verName := versionName(data.cacheDir, data.name, Meta.CurrVer)
+
+	js, err := json.MarshalIndent(Meta, "", "    ")
+	if err != nil {
+		log.WithFields(log.Fields{"Version": Meta.CurrVer, "Error": err}).Error("Commit: Cannot marshal meta")
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(verName), 0700); err != nil {
+		log.WithFields(log.Fields{"Meta File": verName, "Error": err}).Error("Commit: Cannot create version dir")
+		return err
+	}
+
+	// O_EXCL - never overwrite a version
+	verFile, err := os.OpenFile(verName, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
+	if err != nil {
+		log.WithFields(log.Fields{"Meta File": verName, "Error": err}).Error("Commit: Cannot create version meta")
+		return err
+	}
+	defer verFile.Close()
+
+	if _, err := verFile.Write(js); err != nil {
+		log.WithFields(log.Fields{"Meta File": verName, "Error": err}).Error("Commit: Cannot write version meta")
+		os.Remove(verName)
+		return err
+	}
+
+	return nil
+}
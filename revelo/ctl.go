@@ -0,0 +1,172 @@
+//
+// Control socket - horcrux-cli commands on a mount (commit, ...) are
+// run by the process serving the mount. Each mount listens on
+// CTL_SOCK in its working dir (<cacheDir>, or <cacheDir>/CACHE_VERDIR/<ver>),
+// one JSON CtlRequest and CtlResponse per connection.
+//
+
+package revelo
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const CTL_SOCK = "ctl.sock"
+
+// Control commands
+const (
+	CTL_COMMIT = "commit"
+	CTL_STATUS = "status"
+	CTL_RESET  = "reset"
+	CTL_PULL   = "pull"
+)
+
+// Reply from a mount, for requests of another mount dir
+const ctlNotMounted = "not mounted here"
+
+type CtlRequest struct {
+	Cmd     string   `json:"Cmd"`
+	MntDir  string   `json:"Mount Dir"`
+	Message string   `json:"Message,omitempty"`
+	Author  string   `json:"Author,omitempty"`
+	Paths   []string `json:"Paths,omitempty"`
+}
+
+type CtlResponse struct {
+	Version string   `json:"Version,omitempty"`
+	Changes []Change `json:"Changes,omitempty"`
+	Err     string   `json:"Err,omitempty"`
+}
+
+// Listens on control socket of mount data
+func serveCtl(data *ReveloData) (net.Listener, error) {
+	sockName := data.workDir + "/" + CTL_SOCK
+
+	// Left over from an earlier mount
+	os.Remove(sockName)
+
+	l, err := net.Listen("unix", sockName)
+	if err != nil {
+		log.WithFields(log.Fields{"Socket": sockName, "Error": err}).Error("Revelo: Cannot listen on control socket")
+		return nil, err
+	}
+
+	// Only the owner of the mount can run commands on it
+	if err := os.Chmod(sockName, 0600); err != nil {
+		log.WithFields(log.Fields{"Socket": sockName, "Error": err}).Error("Revelo: Cannot set mode of control socket")
+		l.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// Closed on unmount
+				log.WithFields(log.Fields{"Socket": sockName, "Error": err}).Debug("Revelo: Control socket done")
+				return
+			}
+			go handleCtl(data, conn)
+		}
+	}()
+
+	return l, nil
+}
+
+func handleCtl(data *ReveloData, conn net.Conn) {
+	defer conn.Close()
+
+	req := new(CtlRequest)
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Revelo: Invalid control request")
+		return
+	}
+
+	log.WithFields(log.Fields{"Req": req}).Debug("Revelo: Control request")
+
+	resp := new(CtlResponse)
+	var err error
+
+	switch {
+	case req.MntDir != data.mntDir:
+		err = errors.New(ctlNotMounted)
+	case req.Cmd == CTL_COMMIT:
+		resp.Version, err = commit(data, req.Message, req.Author)
+	case req.Cmd == CTL_STATUS:
+		resp.Version = data.CurrVer
+		resp.Changes, err = status(data)
+	case req.Cmd == CTL_RESET:
+		resp.Version = data.CurrVer
+		resp.Changes, err = reset(data, req.Paths)
+	case req.Cmd == CTL_PULL:
+		// Changes are the conflicts, on error
+		resp.Version, resp.Changes, err = pull(data)
+	default:
+		err = syscall.EINVAL
+	}
+
+	if err != nil {
+		resp.Err = err.Error()
+	}
+
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// Sends req to the mount at req.MntDir - its control socket is in one
+// of the cache dirs in workDir (<workDir>/<name>/...)
+func Control(workDir string, req *CtlRequest) (*CtlResponse, error) {
+	mntDir, err := filepath.Abs(req.MntDir)
+	if err != nil {
+		return nil, err
+	}
+	req.MntDir = mntDir
+
+	socks, _ := filepath.Glob(workDir + "/*/" + CTL_SOCK)
+	verSocks, _ := filepath.Glob(workDir + "/*/" + CACHE_VERDIR + "/*/" + CTL_SOCK)
+	socks = append(socks, verSocks...)
+	for _, sockName := range socks {
+		resp, err := sendCtl(sockName, req)
+		if err != nil {
+			// Stale socket or some other mount
+			continue
+		}
+
+		if resp.Err != "" {
+			return resp, errors.New(resp.Err)
+		}
+		return resp, nil
+	}
+
+	log.WithFields(log.Fields{"mntDir": mntDir, "Work Dir": workDir}).Error("Revelo: No horcrux mounted")
+	return nil, syscall.ENOENT
+}
+
+// Returns error if the socket is not of req.MntDir
+func sendCtl(sockName string, req *CtlRequest) (*CtlResponse, error) {
+	conn, err := net.Dial("unix", sockName)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	resp := new(CtlResponse)
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Err == ctlNotMounted {
+		return nil, syscall.ENOENT
+	}
+	return resp, nil
+}
@@ -275,12 +275,10 @@ func Update(root *Node, old horcrux.Entry, new horcrux.Entry) error {
 	return nil
 }
 
-// Delete dir/file with prefix dir in tree at root
-func Delete(root *Node, dir string, file string, isDir bool) (*horcrux.Entry, error) {
+// Node of dir (prefix of its kids) in tree at root
+func dirNode(root *Node, dir string) (*Node, error) {
 	var dirPrefix, dirName string
 
-	log.WithFields(log.Fields{"Root": root.Entry.Name, "Dir": dir, "File": file}).Debug("Delete:")
-
 	sl := strings.Index(dir, "/")
 	if sl == -1 {
 		dirPrefix = ""
@@ -295,6 +293,21 @@ func Delete(root *Node, dir string, file string, isDir bool) (*horcrux.Entry, er
 		return nil, err
 	}
 
+	if n.Entry.IsDir == false {
+		return nil, syscall.ENOTDIR
+	}
+	return n, nil
+}
+
+// Delete dir/file with prefix dir in tree at root
+func Delete(root *Node, dir string, file string, isDir bool) (*horcrux.Entry, error) {
+	log.WithFields(log.Fields{"Root": root.Entry.Name, "Dir": dir, "File": file}).Debug("Delete:")
+
+	n, err := dirNode(root, dir)
+	if err != nil {
+		return nil, err
+	}
+
 	var i int
 	for i = 0; i < n.numKids; i++ {
 		if n.kidsArr[i] == file {
@@ -321,11 +334,98 @@ func Delete(root *Node, dir string, file string, isDir bool) (*horcrux.Entry, er
 		}
 	}
 
-	n.kidsArr = append(n.kidsArr[:i], n.kidsArr[i+1:]...)
+	removeKid(n, file)
+	return &k.Entry, nil
+}
+
+func removeKid(n *Node, file string) {
+	for i := 0; i < n.numKids; i++ {
+		if n.kidsArr[i] == file {
+			n.kidsArr = append(n.kidsArr[:i], n.kidsArr[i+1:]...)
+			break
+		}
+	}
 	delete(n.kidsMap, file)
 	n.numKids--
+}
 
-	return &k.Entry, nil
+// Moves file (or dir, with all below it) in oldDir to newDir as newFile,
+// in tree at root - entries keep all but their path
+//  - newFile in newDir, if there, is replaced - a file by a file, a dir by
+//    an empty dir - and returned
+//  - Dir cannot be moved below itself
+func Rename(root *Node, oldDir string, file string, newDir string, newFile string) (*horcrux.Entry, error) {
+	log.WithFields(log.Fields{
+		"Root":     root.Entry.Name,
+		"Old Dir":  oldDir,
+		"File":     file,
+		"New Dir":  newDir,
+		"New File": newFile,
+	}).Debug("Rename:")
+
+	on, err := dirNode(root, oldDir)
+	if err != nil {
+		return nil, err
+	}
+
+	nn, err := dirNode(root, newDir)
+	if err != nil {
+		return nil, err
+	}
+
+	k, ok := on.kidsMap[file]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	if on == nn && file == newFile {
+		return nil, nil
+	}
+
+	if k.Entry.IsDir {
+		kidPrefix := oldDir + "/" + file
+		if newDir == kidPrefix || strings.HasPrefix(newDir, kidPrefix+"/") {
+			log.WithFields(log.Fields{"Dir": kidPrefix, "New Dir": newDir}).Info("Rename: Dir below itself")
+			return nil, syscall.EINVAL
+		}
+	}
+
+	var replaced *horcrux.Entry
+	if t, ok := nn.kidsMap[newFile]; ok {
+		switch {
+		case k.Entry.IsDir && !t.Entry.IsDir:
+			return nil, syscall.ENOTDIR
+		case !k.Entry.IsDir && t.Entry.IsDir:
+			return nil, syscall.EISDIR
+		case t.numKids != 0:
+			return nil, syscall.ENOTEMPTY
+		}
+
+		removeKid(nn, newFile)
+		replaced = &t.Entry
+	}
+
+	removeKid(on, file)
+
+	k.Entry.Prefix = newDir
+	k.Entry.Name = newFile
+	nn.kidsMap[newFile] = k
+	nn.kidsArr = append(nn.kidsArr, newFile)
+	nn.numKids++
+
+	setPrefix(k)
+	return replaced, nil
+}
+
+// Sets prefix of all below dir node n, from its path
+func setPrefix(n *Node) {
+	prefix := n.Entry.Prefix + "/" + n.Entry.Name
+	for _, k := range n.kidsMap {
+		k.Entry.Prefix = prefix
+		if k.Entry.IsDir {
+			setPrefix(k)
+		}
+	}
 }
 
 // Create a dirTree from the flat Meta info
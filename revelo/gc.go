@@ -0,0 +1,225 @@
+//
+// GC - deletes remote chunks no meta refers to
+//  - Live chunks are the chunks of all metas in the remote - latest
+//    (<name>.meta) and versions (vN/<name>.meta), of all horcruxes in it,
+//    as they share the chunk store
+//  - Any meta that cannot be read stops gc - its chunks are not known
+//  - Deletes in two passes, grace apart: a chunk is deleted only if an
+//    earlier gc found it unreferenced at least grace ago, and it was not
+//    put since. Chunks are pushed before the metas that refer to them, and
+//    mounts of a version removed lately still read its chunks - both get
+//    grace time.
+//  - Unreferenced chunks found are kept in remote GC_FILE, till deleted
+//  - Dry run only tells what would be deleted - nothing is changed
+//
+
+package revelo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/accio"
+)
+
+const (
+	GC_FILE  = "horcrux.gc"
+	GC_GRACE = 24 * time.Hour // Default grace
+)
+
+type GCResult struct {
+	Metas   int      `json:"Metas"`
+	Chunks  int      `json:"Chunks"` // In remote
+	Live    int      `json:"Live Chunks"`
+	Marked  int      `json:"Marked Chunks"` // Unreferenced, to be deleted by a later gc
+	Deleted []string `json:"Deleted"`       // Remote names - to be deleted, in dry run
+	Bytes   int64    `json:"Deleted Bytes"`
+}
+
+// Unreferenced chunks, by name below remote top dir
+type gcMarks struct {
+	Marked map[string]int64 `json:"Marked"` // Unix time found unreferenced first
+}
+
+// Deletes unreferenced chunks of remote at accType, found so at least grace ago
+func GC(accType string, key []byte, cacheDir string, grace time.Duration, dryRun bool) (*GCResult, error) {
+	acc, remoteDir, err := remoteAccess(accType)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := acc.List(remoteDir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(GCResult)
+	var chunks []accio.FileInfo
+	live := make(map[string]bool)
+	for _, fi := range files {
+		name := gcName(remoteDir, fi.Name)
+		if strings.HasPrefix(name, horcrux.CHUNKDIR+"/") {
+			chunks = append(chunks, fi)
+			continue
+		}
+
+		if !isMetaName(name) {
+			continue
+		}
+
+		Meta, err := getRemoteFile(acc, fi.Name, key, cacheDir)
+		if err != nil {
+			log.WithFields(log.Fields{"Meta": fi.Name, "Error": err}).Error("GC: Cannot read meta, nothing deleted")
+			return nil, err
+		}
+
+		result.Metas++
+		for hash := range horcrux.ChunkSet(Meta) {
+			live[hash] = true
+		}
+	}
+
+	marks, err := getGCMarks(acc, remoteDir, cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	newMarks := &gcMarks{Marked: make(map[string]int64)}
+	var dead []accio.FileInfo
+	for _, fi := range chunks {
+		result.Chunks++
+
+		// Left over tmp files of failed puts are not live either
+		if live[path.Base(fi.Name)] {
+			result.Live++
+			continue
+		}
+
+		name := gcName(remoteDir, fi.Name)
+		marked, ok := marks.Marked[name]
+		if !ok || fi.ModTime.Unix() > marked {
+			// New, or put again since
+			marked = now.Unix()
+		}
+
+		if now.Sub(time.Unix(marked, 0)) >= grace && now.Sub(fi.ModTime) >= grace {
+			dead = append(dead, fi)
+			continue
+		}
+
+		newMarks.Marked[name] = marked
+		result.Marked++
+	}
+
+	sort.Slice(dead, func(i, j int) bool { return dead[i].Name < dead[j].Name })
+	for _, fi := range dead {
+		if !dryRun {
+			if err := acc.DeleteFile(fi.Name); err != nil {
+				log.WithFields(log.Fields{"Chunk": fi.Name, "Error": err}).Error("GC: Cannot delete chunk")
+				return nil, err
+			}
+		}
+		result.Deleted = append(result.Deleted, fi.Name)
+		result.Bytes += fi.Size
+	}
+
+	if !dryRun && (len(newMarks.Marked) > 0 || len(marks.Marked) > 0) {
+		if err := putGCMarks(acc, remoteDir, newMarks, cacheDir); err != nil {
+			return nil, err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"Metas":   result.Metas,
+		"Chunks":  result.Chunks,
+		"Live":    result.Live,
+		"Marked":  result.Marked,
+		"Deleted": len(result.Deleted),
+		"Bytes":   result.Bytes,
+		"Dry Run": dryRun,
+	}).Info("GC: Done")
+	return result, nil
+}
+
+// Name of remote file below remoteDir
+func gcName(remoteDir string, name string) string {
+	if remoteDir == "" {
+		return name
+	}
+	return strings.TrimPrefix(path.Clean(name), path.Clean(remoteDir)+"/")
+}
+
+// <name>.meta or vN/<name>.meta
+func isMetaName(name string) bool {
+	if !strings.HasSuffix(name, ".meta") {
+		return false
+	}
+
+	parts := strings.Split(name, "/")
+	switch len(parts) {
+	case 1:
+		return true
+	case 2:
+		_, err := horcrux.VerNum(parts[0])
+		return err == nil
+	}
+	return false
+}
+
+// Gets remote gc marks - none, if there is no gc file yet
+func getGCMarks(acc accio.Access, remoteDir string, cacheDir string) (*gcMarks, error) {
+	marks := &gcMarks{Marked: make(map[string]int64)}
+
+	tmpFile, err := ioutil.TempFile(cacheDir, "gc.")
+	if err != nil {
+		log.WithFields(log.Fields{"cacheDir": cacheDir, "Error": err}).Error("GC: Cannot create tmp file")
+		return nil, err
+	}
+	tmpName := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpName)
+
+	remoteName := remotePath(remoteDir, GC_FILE)
+	if err := acc.GetFile(remoteName, tmpName); err != nil {
+		if os.IsNotExist(err) {
+			return marks, nil
+		}
+		log.WithFields(log.Fields{"Remote": remoteName, "Error": err}).Error("GC: Cannot get gc file")
+		return nil, err
+	}
+
+	js, err := ioutil.ReadFile(tmpName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(js, marks); err != nil {
+		log.WithFields(log.Fields{"Remote": remoteName, "Error": err}).Error("GC: Cannot unmarshal gc file")
+		return nil, err
+	}
+
+	if marks.Marked == nil {
+		marks.Marked = make(map[string]int64)
+	}
+	return marks, nil
+}
+
+// Chunk names are hashes, no need to encrypt
+func putGCMarks(acc accio.Access, remoteDir string, marks *gcMarks, cacheDir string) error {
+	js, err := json.MarshalIndent(marks, "", "    ")
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("GC: Cannot marshal gc file")
+		return err
+	}
+
+	return putData(acc, js, remotePath(remoteDir, GC_FILE), cacheDir)
+}
@@ -0,0 +1,175 @@
+//
+// History - version records of a horcrux, as kept in its meta (horcrux.Version)
+//  - Read from remote latest meta, no mount needed
+//  - Records are only appended to, by generate, update and commit. Records
+//    of pruned versions are not listed (see prune.go)
+//  - Two remote versions can be compared, from their version metas
+//  - Info of a version has its root hash (horcrux.RootHash) - same root
+//    hash is same dataset
+//
+
+package revelo
+
+import (
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+)
+
+// Version history of horcrux Name at accType, oldest first
+func Log(Name string, accType string, key []byte, cacheDir string) ([]horcrux.Version, error) {
+	acc, remoteDir, err := remoteAccess(accType)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := getRemoteMeta(acc, remoteDir, Name, key, cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	history := remote.History
+	if remote.Version() == nil {
+		// Made before history was kept
+		history = append(history, horcrux.Version{Name: remote.CurrVer})
+	}
+
+	// Pruned versions stay in the history
+	vers, err := remoteVersions(acc, remoteDir, Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return liveHistory(history, remote.CurrVer, func(ver string) bool { return vers[ver] }), nil
+}
+
+// Summary of a version
+type VersionInfo struct {
+	Name     string           `json:"Name"`
+	Version  string           `json:"Version"`
+	Root     string           `json:"Root Hash"`
+	Config   horcrux.Config   `json:"Config"`
+	Record   *horcrux.Version `json:"Record,omitempty"`
+	Files    int              `json:"Files"`
+	Size     int64            `json:"Size"`
+	Chunks   int              `json:"Chunks"`
+	SignedBy string           `json:"Signed By,omitempty"` // Public key, not verified
+}
+
+// Info of version ver of horcrux Name at accType - a version, tag or
+// branch, latest if ver is empty
+func Info(Name string, accType string, key []byte, cacheDir string, ver string) (*VersionInfo, error) {
+	acc, remoteDir, err := remoteAccess(accType)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta *horcrux.Meta
+	if ver == "" {
+		meta, err = getRemoteMeta(acc, remoteDir, Name, key, cacheDir)
+	} else {
+		ver, err = resolveVersion(acc, remoteDir, Name, key, cacheDir, ver)
+		if err != nil {
+			return nil, err
+		}
+
+		meta, err = getRemoteFile(acc, remotePath(remoteDir, horcrux.VerMetaPath(ver, Name)), key, cacheDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stats horcrux.Version
+	horcrux.VersionStats(&stats, meta, nil)
+
+	info := &VersionInfo{
+		Name:    Name,
+		Version: meta.CurrVer,
+		Root:    meta.Root,
+		Config:  meta.Config,
+		Record:  meta.Version(),
+		Files:   stats.Files,
+		Size:    stats.Size,
+		Chunks:  stats.Chunks,
+	}
+
+	if meta.Signature != nil {
+		info.SignedBy = meta.Signature.Key
+	}
+
+	return info, nil
+}
+
+// Changes between two versions, with totals
+type VersionDiff struct {
+	From     string   `json:"From"`
+	To       string   `json:"To"`
+	Changes  []Change `json:"Changes"`
+	Added    int      `json:"Added"`
+	Removed  int      `json:"Removed"`
+	Modified int      `json:"Modified"`
+	Chunks   int      `json:"Changed Chunks"` // Sum of file changed chunks
+	Bytes    int64    `json:"Changed Bytes"`  // Sum of file changed bytes
+
+	// Chunks in To, not in From - what To adds to the store
+	NewChunks int `json:"New Chunks"`
+}
+
+// Changes from version from to version to (versions or refs), of horcrux
+// Name at accType
+func DiffVersions(Name string, accType string, key []byte, cacheDir string, from string, to string) (*VersionDiff, error) {
+	acc, remoteDir, err := remoteAccess(accType)
+	if err != nil {
+		return nil, err
+	}
+
+	var vers [2]string
+	var metas [2]*horcrux.Meta
+	for i, ref := range []string{from, to} {
+		vers[i], err = resolveVersion(acc, remoteDir, Name, key, cacheDir, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		metas[i], err = getRemoteFile(acc, remotePath(remoteDir, horcrux.VerMetaPath(vers[i], Name)), key, cacheDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Versions have no local chunks
+	noDirty := func(entry *horcrux.Entry, idx int64) (string, error) {
+		log.WithFields(log.Fields{"Name": entry.Name, "Chunk": idx}).Error("Diff: Chunk without hash")
+		return "", syscall.EINVAL
+	}
+
+	changes, err := diffMeta(metas[1].Config, metas[0], metas[1], noDirty)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &VersionDiff{From: vers[0], To: vers[1], Changes: changes}
+	for _, ch := range changes {
+		switch ch.Type {
+		case CHANGE_ADDED:
+			diff.Added++
+		case CHANGE_REMOVED:
+			diff.Removed++
+		case CHANGE_MODIFIED:
+			diff.Modified++
+		}
+		diff.Chunks += ch.Chunks
+		diff.Bytes += ch.Bytes
+	}
+
+	fromChunks := horcrux.ChunkSet(metas[0])
+	for hash := range horcrux.ChunkSet(metas[1]) {
+		if !fromChunks[hash] {
+			diff.NewChunks++
+		}
+	}
+
+	return diff, nil
+}
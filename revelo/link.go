@@ -0,0 +1,187 @@
+//
+// Hard links - names of a file with the same inode
+//  - Meta has the data (stat and chunks) in one entry of the inode, other
+//    names are HardLink entries without chunks (see horcrux.Entry)
+//  - All names of a file share its FILE (see node.go), with the entry that
+//    has the data - writes to any name update that entry
+//  - When the entry with the data is removed, the data (and its dirty
+//    chunks) move to another name
+//
+
+package revelo
+
+import (
+	"github.com/muthu-r/horcrux/bazil-fuse/fuse"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/revelo/dirTree"
+)
+
+// Names of a file with hard links, as tree nodes
+type fileLinks struct {
+	file  *dirTree.Node   // Has the data
+	links []*dirTree.Node // HardLink entries
+}
+
+// Sets links of data from Meta, its tree is root
+// Caller holds data.lock, if data is in use
+func setLinks(data *ReveloData, root *dirTree.Node, Meta *horcrux.Meta) {
+	links := make(map[uint64]*fileLinks)
+	for i := range Meta.Entries {
+		entry := &Meta.Entries[i]
+		if !entry.HardLink {
+			continue
+		}
+
+		n, err := dirTree.Lookup(root, entry.Prefix, entry.Name)
+		if err != nil {
+			continue
+		}
+
+		l := links[entry.Ino]
+		if l == nil {
+			l = &fileLinks{}
+			links[entry.Ino] = l
+		}
+		l.links = append(l.links, n)
+	}
+
+	for i := range Meta.Entries {
+		entry := &Meta.Entries[i]
+		if l := links[entry.Ino]; l != nil && !entry.HardLink {
+			l.file, _ = dirTree.Lookup(root, entry.Prefix, entry.Name)
+		}
+	}
+
+	// Hard links of a missing file are fixed by SetInodes on load
+	for ino, l := range links {
+		if l.file == nil {
+			log.WithFields(log.Fields{"Inode": ino}).Error("Revelo: Hard links without their file")
+			delete(links, ino)
+		}
+	}
+
+	data.links = links
+}
+
+// Entry with the data of entry - itself, if its not a hard link
+// Caller holds data.lock
+func linkFile(data *ReveloData, entry horcrux.Entry) horcrux.Entry {
+	if l := data.links[entry.Ino]; l != nil && entry.HardLink {
+		return l.file.Entry
+	}
+	return entry
+}
+
+// Number of names of the file with inode ino
+// Caller holds data.lock
+func numLinks(data *ReveloData, ino uint64) uint32 {
+	if l := data.links[ino]; l != nil {
+		return uint32(len(l.links) + 1)
+	}
+	return 1
+}
+
+// Adds name in dir prefix to file - a hard link to it
+// Caller holds data.lock
+func addLink(data *ReveloData, file horcrux.Entry, prefix string, name string) error {
+	fn, err := dirTree.Lookup(data.Root, file.Prefix, file.Name)
+	if err != nil {
+		return fuse.ENOENT
+	}
+
+	entry := horcrux.Entry{Name: name, Prefix: prefix, Stat: fn.Entry.Stat, Ino: fn.Entry.Ino, HardLink: true}
+	if err := dirTree.Insert(data.Root, entry); err != nil {
+		return err
+	}
+
+	n, err := dirTree.Lookup(data.Root, prefix, name)
+	if err != nil {
+		return err
+	}
+
+	l := data.links[entry.Ino]
+	if l == nil {
+		l = &fileLinks{file: fn}
+		if data.links == nil {
+			data.links = make(map[uint64]*fileLinks)
+		}
+		data.links[entry.Ino] = l
+	}
+	l.links = append(l.links, n)
+	return nil
+}
+
+// Drops removed (entry of a node taken out of the tree) from the names of
+// its file. If it had the data, the data goes to another name - its entry
+// is returned, with true.
+// Caller holds data.lock
+func unlink(data *ReveloData, removed *horcrux.Entry) (horcrux.Entry, bool) {
+	l := data.links[removed.Ino]
+	if l == nil {
+		return horcrux.Entry{}, false
+	}
+
+	var moved bool
+	if removed == &l.file.Entry {
+		n := l.links[0]
+		l.links = l.links[1:]
+
+		entry := *removed
+		entry.Name = n.Entry.Name
+		entry.Prefix = n.Entry.Prefix
+		n.Entry = entry
+		l.file = n
+		moved = true
+	} else {
+		for i, n := range l.links {
+			if removed == &n.Entry {
+				l.links = append(l.links[:i], l.links[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if len(l.links) == 0 {
+		delete(data.links, removed.Ino)
+	}
+
+	if moved {
+		return l.file.Entry, true
+	}
+	return horcrux.Entry{}, false
+}
+
+// Data of a file moved to entry (see unlink) - its dirty chunks were at
+// oldName, and its node gets the new entry
+func moveFile(data *ReveloData, oldName string, entry horcrux.Entry) error {
+	newName := entryCacheName(data, &entry)
+	err := moveDirtyChunks(oldName, newName, &entry)
+
+	data.nodeLock.Lock()
+	n := data.nodes[entry.Ino]
+	data.nodeLock.Unlock()
+
+	if f, ok := n.(*FILE); ok {
+		f.setEntry(entry, newName)
+	}
+	return err
+}
+
+// Are oldDir/oldName and newDir/newName names of the same file
+// Caller holds data.lock
+func sameFile(data *ReveloData, oldDir string, oldName string, newDir string, newName string) bool {
+	on, err := dirTree.Lookup(data.Root, oldDir, oldName)
+	if err != nil {
+		return false
+	}
+
+	nn, err := dirTree.Lookup(data.Root, newDir, newName)
+	if err != nil {
+		return false
+	}
+
+	return on != nn && !on.Entry.IsDir && !nn.Entry.IsDir && on.Entry.Ino == nn.Entry.Ino
+}
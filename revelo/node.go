@@ -0,0 +1,207 @@
+//
+// Nodes - FILE and DIR of entries the kernel has, by inode
+//  - Inodes are kept in the meta (horcrux.Entry.Ino) - same across mounts,
+//    versions and renames. New entries get the next free one.
+//  - Lookups of an entry give the same node till the kernel forgets it, so
+//    all opens and writers of a file share one FILE (and its HANDLE)
+//  - Entry of a node is refreshed on lookup - the tree can be changed under
+//    it (ex: reset, pull)
+//  - Snapshots (see snapshot.go) have their own nodes. Their entries have
+//    the inodes of the mount, so the kernel gets inodes made by
+//    GenerateInode for them - as for the dirs not in the tree.
+//
+
+package revelo
+
+import (
+	"github.com/muthu-r/horcrux/bazil-fuse/fuse"
+	"github.com/muthu-r/horcrux/bazil-fuse/fuse/fs"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/revelo/dirTree"
+)
+
+// Set in inodes made by GenerateInode - meta inodes are below it
+const DYN_INODE = 1 << 63
+
+func (f FS) GenerateInode(parentInode uint64, name string) uint64 {
+	return fs.GenerateDynamicInode(parentInode, name) | DYN_INODE
+}
+
+// Inode of entry the kernel gets - 0 for one made by GenerateInode
+func nodeInode(data *ReveloData, entry *horcrux.Entry) uint64 {
+	if data.snapshot {
+		return 0
+	}
+	return entry.Ino
+}
+
+// Sets inodes of Meta entries that have none or a taken one (see
+// horcrux.SetInodes), and the next free inode of data
+// Caller holds data.lock, if data is in use
+func setInodes(data *ReveloData, Meta *horcrux.Meta) {
+	next := horcrux.SetInodes(Meta, nil)
+	if next > data.nextIno {
+		data.nextIno = next
+	}
+}
+
+// Next free inode, for a new entry
+// Caller holds data.lock
+func newInode(data *ReveloData) uint64 {
+	ino := data.nextIno
+	data.nextIno++
+	return ino
+}
+
+// Node of entry in dir d - the one the kernel has, if any
+// Entry of a hard link is the one with the data (see link.go), not in d
+func getNode(d *DIR, entry horcrux.Entry) fs.Node {
+	data := d.RData
+	cacheName := entryCacheName(data, &entry)
+
+	data.nodeLock.Lock()
+	defer data.nodeLock.Unlock()
+
+	switch n := data.nodes[entry.Ino].(type) {
+	case *FILE:
+		if !entry.IsDir {
+			n.setEntry(entry, cacheName)
+			return n
+		}
+	case *DIR:
+		if entry.IsDir {
+			n.setEntry(entry, cacheName)
+			return n
+		}
+	}
+
+	var n fs.Node
+	if entry.IsDir {
+		n = &DIR{Acc: d.Acc, RData: data, Entry: entry, cacheDir: cacheName}
+	} else {
+		n = &FILE{Acc: d.Acc, RData: data, Entry: entry, cacheName: cacheName}
+	}
+
+	addNode(data, entry.Ino, n)
+	return n
+}
+
+// Caller holds data.nodeLock
+func addNode(data *ReveloData, ino uint64, n fs.Node) {
+	if data.nodes == nil {
+		data.nodes = make(map[uint64]fs.Node)
+	}
+	data.nodes[ino] = n
+}
+
+// Adds new node n of entry ino
+func putNode(data *ReveloData, ino uint64, n fs.Node) {
+	data.nodeLock.Lock()
+	addNode(data, ino, n)
+	data.nodeLock.Unlock()
+}
+
+// Drops n, if its still the node of ino
+func dropNode(data *ReveloData, ino uint64, n fs.Node) {
+	data.nodeLock.Lock()
+	if data.nodes[ino] == n {
+		delete(data.nodes, ino)
+	}
+	data.nodeLock.Unlock()
+}
+
+func (f *FILE) setEntry(entry horcrux.Entry, cacheName string) {
+	f.lock.Lock()
+	f.Entry = entry
+	f.cacheName = cacheName
+	f.lock.Unlock()
+}
+
+func (d *DIR) setEntry(entry horcrux.Entry, cacheDir string) {
+	d.lock.Lock()
+	d.Entry = entry
+	d.cacheDir = cacheDir
+	d.lock.Unlock()
+}
+
+func (f *FILE) Forget() {
+	f.lock.RLock()
+	ino := f.Entry.Ino
+	f.lock.RUnlock()
+
+	dropNode(f.RData, ino, f)
+}
+
+func (d *DIR) Forget() {
+	d.lock.RLock()
+	ino := d.Entry.Ino
+	d.lock.RUnlock()
+
+	dropNode(d.RData, ino, d)
+}
+
+// Moved entry at prefix/name, and all below it if its a dir, get their new
+// path in their nodes. cacheName is the new dirty chunk name of the entry.
+func moveNodes(data *ReveloData, prefix string, name string, cacheName string) {
+	type moved struct {
+		entry     horcrux.Entry
+		cacheName string
+	}
+
+	// Nodes are locked after the tree - writers lock them the other way
+	var list []moved
+	var walk func(n *dirTree.Node, cacheName string)
+	walk = func(n *dirTree.Node, cacheName string) {
+		// Node of a hard link has the entry with the data
+		if !n.Entry.HardLink {
+			list = append(list, moved{n.Entry, cacheName})
+		}
+		for i := 0; i < dirTree.NumKids(n); i++ {
+			k, _ := dirTree.GetKid(n, i)
+			walk(&k, cacheName+"/"+k.Entry.Name)
+		}
+	}
+
+	data.lock.RLock()
+	if n, err := dirTree.Lookup(data.Root, prefix, name); err == nil {
+		walk(n, cacheName)
+	}
+	data.lock.RUnlock()
+
+	for _, m := range list {
+		data.nodeLock.Lock()
+		n := data.nodes[m.entry.Ino]
+		data.nodeLock.Unlock()
+
+		switch n := n.(type) {
+		case *FILE:
+			n.setEntry(m.entry, m.cacheName)
+		case *DIR:
+			n.setEntry(m.entry, m.cacheName)
+		}
+	}
+}
+
+// Attr of entry for the kernel
+func entryAttr(data *ReveloData, entry *horcrux.Entry, a *fuse.Attr) {
+	a.Inode = nodeInode(data, entry)
+	a.Mode = entry.Stat.Mode
+	a.Size = uint64(entry.Stat.Size)
+	a.Uid = entry.Stat.Uid
+	a.Gid = entry.Stat.Gid
+	statTimes(&entry.Stat, a)
+
+	if !entry.IsDir {
+		data.lock.RLock()
+		a.Nlink = numLinks(data, entry.Ino)
+		data.lock.RUnlock()
+	}
+}
+
+// Entry and dirty chunks dir of d
+func (d *DIR) get() (horcrux.Entry, string) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.Entry, d.cacheDir
+}
@@ -0,0 +1,244 @@
+//
+// Prune - removes remote versions by a retention policy
+//  - Only version metas (vN/<name>.meta) are removed, their chunks are left
+//    to gc (see gc.go) - mounts of a removed version keep working till then
+//  - Latest version is always kept, and versions newer than it (a push in
+//    progress)
+//  - Keep last N: the N latest versions
+//  - Keep daily D: the latest version of each of the D latest days with
+//    versions. Versions made before history was kept have no time, only
+//    keep last applies to them.
+//  - Keep tagged: versions tags or branches point to. Without it, refs to
+//    removed versions are removed too.
+//  - Version history in the meta is kept as is (the meta is signed), log
+//    and SNAP_VERDIR list only the versions still there
+//
+
+package revelo
+
+import (
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/accio"
+)
+
+type PrunePolicy struct {
+	KeepLast   int
+	KeepDaily  int
+	KeepTagged bool
+}
+
+type PruneResult struct {
+	Name    string   `json:"Name"`
+	Kept    []string `json:"Kept"`
+	Removed []string `json:"Removed"`                // To be removed, in dry run
+	Refs    []string `json:"Removed Refs,omitempty"` // <kind>:<ref>, of removed versions
+}
+
+// Prunes versions of horcruxes names at accType by policy - all horcruxes
+// there, if no names
+func Prune(accType string, names []string, key []byte, cacheDir string, policy PrunePolicy, dryRun bool) ([]PruneResult, error) {
+	if policy.KeepLast <= 0 && policy.KeepDaily <= 0 && !policy.KeepTagged {
+		log.WithFields(log.Fields{"Policy": policy}).Error("Prune: No versions to keep given")
+		return nil, syscall.EINVAL
+	}
+
+	acc, remoteDir, err := remoteAccess(accType)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, heads, err := listVersions(acc, remoteDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		sort.Strings(heads)
+		names = heads
+	}
+
+	var results []PruneResult
+	for _, Name := range names {
+		head, err := getRemoteMeta(acc, remoteDir, Name, key, cacheDir)
+		if err != nil {
+			return results, err
+		}
+
+		refs, err := getRefs(acc, remoteDir, Name, key, cacheDir)
+		if err != nil {
+			return results, err
+		}
+
+		keep, err := pruneKeep(head, versions[Name], refs, policy)
+		if err != nil {
+			return results, err
+		}
+
+		result := PruneResult{Name: Name}
+		vers := versions[Name]
+		sort.Sort(sort.Reverse(sort.IntSlice(vers)))
+		for _, verNum := range vers {
+			ver := horcrux.VerName(verNum)
+			if keep[ver] {
+				result.Kept = append(result.Kept, ver)
+			} else {
+				result.Removed = append(result.Removed, ver)
+			}
+		}
+
+		// Refs go first - no ref to a missing version
+		removedRefs := false
+		for _, kind := range []string{REF_TAG, REF_BRANCH} {
+			refMap, _ := refs.kind(kind)
+			for ref, ver := range refMap {
+				if !keep[ver] {
+					result.Refs = append(result.Refs, kind+":"+ref)
+					delete(refMap, ref)
+					removedRefs = true
+				}
+			}
+		}
+		sort.Strings(result.Refs)
+
+		if !dryRun {
+			if removedRefs {
+				if err := putRefs(acc, remoteDir, Name, key, head.Config, refs, cacheDir); err != nil {
+					return results, err
+				}
+			}
+
+			for _, ver := range result.Removed {
+				if err := acc.DeleteFile(remotePath(remoteDir, horcrux.VerMetaPath(ver, Name))); err != nil {
+					log.WithFields(log.Fields{"Name": Name, "Version": ver, "Error": err}).Error("Prune: Cannot remove version")
+					return results, err
+				}
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"Name":    Name,
+			"Kept":    len(result.Kept),
+			"Removed": len(result.Removed),
+			"Refs":    len(result.Refs),
+			"Dry Run": dryRun,
+		}).Info("Prune: Done")
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// Remote versions (vN/<name>.meta) by horcrux name, and the horcruxes
+// (<name>.meta) at remoteDir
+func listVersions(acc accio.Access, remoteDir string) (map[string][]int, []string, error) {
+	files, err := acc.List(remoteDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	versions := make(map[string][]int)
+	var heads []string
+	for _, fi := range files {
+		name := gcName(remoteDir, fi.Name)
+		if !isMetaName(name) {
+			continue
+		}
+
+		parts := strings.Split(strings.TrimSuffix(name, ".meta"), "/")
+		if len(parts) == 1 {
+			heads = append(heads, parts[0])
+			continue
+		}
+
+		verNum, _ := horcrux.VerNum(parts[0])
+		versions[parts[1]] = append(versions[parts[1]], verNum)
+	}
+
+	return versions, heads, nil
+}
+
+// Versions of horcrux Name at remoteDir, as a set
+func remoteVersions(acc accio.Access, remoteDir string, Name string) (map[string]bool, error) {
+	versions, _, err := listVersions(acc, remoteDir)
+	if err != nil {
+		return nil, err
+	}
+
+	vers := make(map[string]bool)
+	for _, verNum := range versions[Name] {
+		vers[horcrux.VerName(verNum)] = true
+	}
+	return vers, nil
+}
+
+// Records of history with a version still there (has) - a pruned one is
+// not. Latest version head always is.
+func liveHistory(history []horcrux.Version, head string, has func(string) bool) []horcrux.Version {
+	var live []horcrux.Version
+	for _, rec := range history {
+		if rec.Name == head || has(rec.Name) {
+			live = append(live, rec)
+		}
+	}
+	return live
+}
+
+// Versions of vers (numbers) to keep by policy
+func pruneKeep(head *horcrux.Meta, vers []int, refs *Refs, policy PrunePolicy) (map[string]bool, error) {
+	headNum, err := horcrux.VerNum(head.CurrVer)
+	if err != nil {
+		log.WithFields(log.Fields{"Version": head.CurrVer}).Error("Prune: Invalid latest version")
+		return nil, syscall.EINVAL
+	}
+
+	times := make(map[string]int64)
+	for _, rec := range head.History {
+		times[rec.Name] = rec.Time
+	}
+
+	sorted := append([]int(nil), vers...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+
+	keep := map[string]bool{head.CurrVer: true}
+	days := make(map[string]bool)
+	last := 0
+	for _, verNum := range sorted {
+		ver := horcrux.VerName(verNum)
+		if verNum > headNum {
+			// Not counted
+			keep[ver] = true
+			continue
+		}
+
+		if last < policy.KeepLast {
+			keep[ver] = true
+			last++
+		}
+
+		if t := times[ver]; t != 0 && len(days) < policy.KeepDaily {
+			day := time.Unix(t, 0).Format("2006-01-02")
+			if !days[day] {
+				days[day] = true
+				keep[ver] = true
+			}
+		}
+	}
+
+	if policy.KeepTagged {
+		for _, ver := range refs.Tags {
+			keep[ver] = true
+		}
+		for _, ver := range refs.Branches {
+			keep[ver] = true
+		}
+	}
+
+	return keep, nil
+}
@@ -0,0 +1,60 @@
+package revelo
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/muthu-r/horcrux"
+)
+
+func keptVersions(keep map[string]bool) string {
+	var vers []string
+	for ver := range keep {
+		vers = append(vers, ver)
+	}
+	sort.Strings(vers)
+	return fmt.Sprint(vers)
+}
+
+func TestPruneKeep(t *testing.T) {
+	// Noon of each day - same local day whatever the time zone
+	day := func(d int64, secs int64) int64 { return d*86400 + 43200 + secs }
+
+	// v1 to v5 over 3 days, v5 latest - v6 is a push in progress
+	head := &horcrux.Meta{CurrVer: "v5", History: []horcrux.Version{
+		{Name: "v1", Time: day(10, 0)},
+		{Name: "v2", Time: day(11, 0)},
+		{Name: "v3", Time: day(11, 60)},
+		{Name: "v4", Time: day(12, 0)},
+		{Name: "v5", Time: day(12, 60)},
+	}}
+	vers := []int{1, 2, 3, 4, 5, 6}
+	refs := &Refs{Tags: map[string]string{"rel": "v1"}, Branches: map[string]string{}}
+
+	keep, err := pruneKeep(head, vers, refs, PrunePolicy{KeepLast: 2})
+	if err != nil || keptVersions(keep) != "[v4 v5 v6]" {
+		t.Errorf("keep last: %v %v", keptVersions(keep), err)
+	}
+
+	// Latest of each day
+	keep, _ = pruneKeep(head, vers, refs, PrunePolicy{KeepDaily: 2})
+	if keptVersions(keep) != "[v3 v5 v6]" {
+		t.Errorf("keep daily: %v", keptVersions(keep))
+	}
+
+	keep, _ = pruneKeep(head, vers, refs, PrunePolicy{KeepLast: 1, KeepTagged: true})
+	if keptVersions(keep) != "[v1 v5 v6]" {
+		t.Errorf("keep tagged: %v", keptVersions(keep))
+	}
+
+	// Versions pruned before are not counted
+	keep, _ = pruneKeep(head, []int{1, 3, 5}, refs, PrunePolicy{KeepLast: 2})
+	if keptVersions(keep) != "[v3 v5]" {
+		t.Errorf("keep last of pruned: %v", keptVersions(keep))
+	}
+
+	if _, err := pruneKeep(&horcrux.Meta{CurrVer: "x"}, vers, refs, PrunePolicy{KeepLast: 1}); err == nil {
+		t.Error("invalid latest version")
+	}
+}
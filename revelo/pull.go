@@ -0,0 +1,259 @@
+//
+// Pull - moves a mount to the remote latest version, keeping local changes
+//  - Remote changes are from the base version (see status.go) to the
+//    remote latest, local changes are from the base to the working state
+//  - Files changed in both (or under a dir removed in the other) are
+//    conflicts - nothing is pulled, they are returned to be sorted out
+//    (ex: reset, or copy elsewhere) first
+//  - Files changed only in remote get their new chunks. Chunks are cached
+//    by hash, so chunks of the old version are not read for them again,
+//    and unchanged chunks are not got again.
+//  - Base has to be a remote version - local versions are pushed first
+//
+
+package revelo
+
+import (
+	"errors"
+	"path"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/revelo/dirTree"
+)
+
+var ErrPullConflict = errors.New("files changed both locally and in remote")
+
+// Pulls remote latest version into horcrux mounted at mntDir
+// Returns the new version and the remote changes pulled - or the
+// conflicts, with ErrPullConflict
+func Pull(mntDir string) (string, []Change, error) {
+	data, err := getMount(mntDir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return pull(data)
+}
+
+func pull(data *ReveloData) (string, []Change, error) {
+	if data.readOnly {
+		return "", nil, syscall.EROFS
+	}
+
+	if data.pinned {
+		log.WithFields(log.Fields{"Version": data.CurrVer}).Error("Pull: Mounted a version, not the latest")
+		return "", nil, syscall.EINVAL
+	}
+
+	// No writes till we are done
+	data.commitLock.Lock()
+	defer data.commitLock.Unlock()
+
+	remote, err := getRemoteMeta(data.acc, data.remoteDir, data.name, data.key, data.cacheDir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := checkMeta(remote); err != nil {
+		return "", nil, err
+	}
+
+	if err := verifyMeta(data, remote); err != nil {
+		return "", nil, err
+	}
+
+	base, err := readMeta(baseName(data), nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if remote.CurrVer == base.CurrVer && sameVersion(remote.Version(), base.Version()) {
+		log.WithFields(log.Fields{"Version": remote.CurrVer}).Info("Pull: Up to date")
+		return remote.CurrVer, nil, nil
+	}
+
+	if err := checkPull(base, remote); err != nil {
+		return "", nil, err
+	}
+
+	local, err := status(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Remote versions have no local chunks
+	noDirty := func(entry *horcrux.Entry, idx int64) (string, error) {
+		log.WithFields(log.Fields{"Name": entry.Name, "Chunk": idx}).Error("Pull: Remote chunk without hash")
+		return "", syscall.EINVAL
+	}
+
+	changes, err := diffMeta(remote.Config, base, remote, noDirty)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if conflicts := pullConflicts(local, changes); len(conflicts) > 0 {
+		log.WithFields(log.Fields{"Conflicts": len(conflicts), "Remote": remote.CurrVer}).Error("Pull: Conflicts")
+		return "", conflicts, ErrPullConflict
+	}
+
+	data.lock.RLock()
+	Meta, err := dirTree.GetMeta(data.Root)
+	data.lock.RUnlock()
+
+	if err != nil {
+		log.Error("Pull: Cannot get Meta data")
+		return "", nil, err
+	}
+
+	Meta.Entries = pullEntries(remote, Meta, local)
+	data.lock.Lock()
+	setInodes(data, Meta)
+	data.lock.Unlock()
+
+	root, err := dirTree.Create(Meta)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Pull: Cannot create dirTree")
+		return "", nil, err
+	}
+
+	data.lock.Lock()
+	data.Root = root
+	setLinks(data, root, Meta)
+	data.NumFiles = len(Meta.Entries)
+	data.CurrVer = remote.CurrVer
+	data.History = remote.History
+	data.lock.Unlock()
+
+	if err := saveMeta(data); err != nil {
+		return "", nil, err
+	}
+
+	if err := writeBase(data, remote); err != nil {
+		return "", nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"From":          base.CurrVer,
+		"To":            remote.CurrVer,
+		"Changes":       len(changes),
+		"Local Changes": len(local),
+	}).Info("Pull: Done")
+	return remote.CurrVer, changes, nil
+}
+
+// Remote has to be made from base
+func checkPull(base *horcrux.Meta, remote *horcrux.Meta) error {
+	if base.Config != remote.Config {
+		log.WithFields(log.Fields{"Local": base.Config, "Remote": remote.Config}).Error("Pull: Remote config changed")
+		return syscall.EINVAL
+	}
+
+	baseNum, err := horcrux.VerNum(base.CurrVer)
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	remoteNum, err := horcrux.VerNum(remote.CurrVer)
+	if err != nil || remoteNum <= baseNum {
+		log.WithFields(log.Fields{"Version": base.CurrVer, "Remote": remote.CurrVer}).Error("Pull: Remote is not newer")
+		return ErrConflict
+	}
+
+	// Made before history was kept - version number is all we have
+	if base.Version() == nil {
+		return nil
+	}
+
+	for i := range remote.History {
+		if remote.History[i].Name == base.CurrVer && sameVersion(&remote.History[i], base.Version()) {
+			return nil
+		}
+	}
+
+	log.WithFields(log.Fields{"Version": base.CurrVer}).Error("Pull: Version not in remote, push it first")
+	return ErrConflict
+}
+
+// Local changes conflicting with remote changes - same path, or under a
+// dir removed in the other
+func pullConflicts(local []Change, remote []Change) []Change {
+	remoteChanges := make(map[string]bool)
+	remoteRemoved := make(map[string]bool)
+	for _, ch := range remote {
+		remoteChanges[ch.Path] = true
+		if ch.Type == CHANGE_REMOVED {
+			remoteRemoved[ch.Path] = true
+		}
+	}
+
+	localRemoved := make(map[string]bool)
+	for _, ch := range local {
+		if ch.Type == CHANGE_REMOVED {
+			localRemoved[ch.Path] = true
+		}
+	}
+
+	underRemoved := func(name string, removed map[string]bool) bool {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if removed[dir] {
+				return true
+			}
+		}
+		return false
+	}
+
+	var conflicts []Change
+	seen := make(map[string]bool)
+	for _, ch := range local {
+		if remoteChanges[ch.Path] || underRemoved(ch.Path, remoteRemoved) {
+			conflicts = append(conflicts, ch)
+			seen[ch.Path] = true
+		}
+	}
+
+	for _, ch := range remote {
+		if !seen[ch.Path] && underRemoved(ch.Path, localRemoved) {
+			conflicts = append(conflicts, ch)
+		}
+	}
+
+	return conflicts
+}
+
+// Entries of remote, with local changes (of Meta) on them
+func pullEntries(remote *horcrux.Meta, Meta *horcrux.Meta, local []Change) []horcrux.Entry {
+	root := remote.Entries[0]
+
+	entries := make(map[string]horcrux.Entry)
+	for i := 1; i < len(remote.Entries); i++ {
+		entries[entryPath(&remote.Entries[i])] = remote.Entries[i]
+	}
+
+	working := make(map[string]horcrux.Entry)
+	for i := 1; i < len(Meta.Entries); i++ {
+		working[entryPath(&Meta.Entries[i])] = Meta.Entries[i]
+	}
+
+	for _, ch := range local {
+		if ch.Type == CHANGE_REMOVED {
+			if entry, ok := entries[ch.Path]; ok && entry.IsDir == ch.IsDir {
+				delete(entries, ch.Path)
+			}
+			continue
+		}
+
+		// Remote root dir name can be different
+		entry := working[ch.Path]
+		entry.Prefix = root.Name
+		if dir := path.Dir(ch.Path); dir != "." {
+			entry.Prefix += "/" + dir
+		}
+		entries[ch.Path] = entry
+	}
+
+	return treeEntries(root, entries)
+}
@@ -0,0 +1,320 @@
+//
+// Push - uploads local versions (see commit.go) to remote
+//  - Versions after the remote latest are pushed, oldest first. The first
+//    one has to be made from the remote latest - else someone else pushed
+//    meanwhile, and we don't merge.
+//  - Chunks not in the remote latest version are encoded (codec) and
+//    uploaded first, then the version meta, and the latest meta
+//    (<name>.meta) last - readers see the new version only when its
+//    all there.
+//  - Versions are signed as pushed, if a sign key is given
+//  - Remote latest is checked again before each version meta is put, and
+//    version metas already in remote are never replaced - a push racing
+//    with another one fails with ErrConflict, and leaves the other as is.
+//    Remotes have no compare and swap, a small window is still there.
+//
+
+package revelo
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/accio"
+	"github.com/muthu-r/horcrux/codec"
+)
+
+var ErrConflict = errors.New("remote has versions not in local")
+
+// Pushes local versions of horcrux Name in cacheDir to remote at accType
+// Returns the remote latest version
+func Push(Name string, accType string, key []byte, signKey ed25519.PrivateKey, cacheDir string) (string, error) {
+	acc, err := initAccess(accType, "")
+	if err != nil {
+		log.Errorf("Push: Invalid Access type: %v", accType)
+		return "", err
+	}
+
+	remoteDir, err := acc.Init()
+	if err != nil {
+		log.WithFields(log.Fields{"Acc": acc, "Error": err}).Error("Push: Cannot init access")
+		return "", err
+	}
+
+	remote, err := getRemoteMeta(acc, remoteDir, Name, key, cacheDir)
+	if err != nil {
+		return "", err
+	}
+
+	locals, err := localVersions(cacheDir, Name)
+	if err != nil {
+		return "", err
+	}
+
+	pending, err := pendingVersions(remote, locals)
+	if err != nil {
+		return "", err
+	}
+
+	if len(pending) == 0 {
+		log.WithFields(log.Fields{"Version": remote.CurrVer}).Info("Push: Nothing to push")
+		return remote.CurrVer, nil
+	}
+
+	c, err := codec.New(remote.Config, key)
+	if err != nil {
+		return "", err
+	}
+
+	have := make(map[string]bool)
+	for _, entry := range remote.Entries {
+		for _, hash := range entry.Chunks {
+			have[hash] = true
+		}
+	}
+
+	pushed := 0
+	for _, Meta := range pending {
+		for _, entry := range Meta.Entries {
+			for _, hash := range entry.Chunks {
+				if have[hash] {
+					continue
+				}
+
+				if err := pushChunk(acc, c, remoteDir, cacheDir, hash); err != nil {
+					return "", err
+				}
+				have[hash] = true
+				pushed++
+			}
+		}
+
+		// Local versions are signed as they go remote
+		if len(signKey) != 0 {
+			if err := codec.SignMeta(signKey, Meta); err != nil {
+				return "", err
+			}
+		}
+
+		verName := remotePath(remoteDir, horcrux.VerMetaPath(Meta.CurrVer, Name))
+		if err := checkRemote(acc, remoteDir, Name, key, cacheDir, remote.CurrVer, verName); err != nil {
+			return "", err
+		}
+
+		if err := putMeta(acc, key, Meta, verName, cacheDir); err != nil {
+			return "", err
+		}
+	}
+
+	// Last check, someone could have pushed while we did
+	now, err := getRemoteMeta(acc, remoteDir, Name, key, cacheDir)
+	if err != nil {
+		return "", err
+	}
+
+	if now.CurrVer != remote.CurrVer {
+		log.WithFields(log.Fields{"Was": remote.CurrVer, "Now": now.CurrVer}).Error("Push: Remote changed while pushing")
+		return "", ErrConflict
+	}
+
+	latest := pending[len(pending)-1]
+	if err := putMeta(acc, key, latest, remotePath(remoteDir, Name+".meta"), cacheDir); err != nil {
+		return "", err
+	}
+
+	log.WithFields(log.Fields{
+		"From":     remote.CurrVer,
+		"To":       latest.CurrVer,
+		"Versions": len(pending),
+		"Chunks":   pushed,
+	}).Info("Push: Done")
+	return latest.CurrVer, nil
+}
+
+// Checks remote latest is still ver, and version meta verName is not there
+// - else someone else is pushing
+func checkRemote(acc accio.Access, remoteDir string, Name string, key []byte, cacheDir string, ver string, verName string) error {
+	now, err := getRemoteMeta(acc, remoteDir, Name, key, cacheDir)
+	if err != nil {
+		return err
+	}
+
+	if now.CurrVer != ver {
+		log.WithFields(log.Fields{"Was": ver, "Now": now.CurrVer}).Error("Push: Remote changed while pushing")
+		return ErrConflict
+	}
+
+	there, err := remoteExists(acc, verName, cacheDir)
+	if err != nil {
+		return err
+	}
+
+	if there {
+		log.WithFields(log.Fields{"Meta": verName}).Error("Push: Version already in remote")
+		return ErrConflict
+	}
+	return nil
+}
+
+// Is remote file remoteName there
+func remoteExists(acc accio.Access, remoteName string, cacheDir string) (bool, error) {
+	tmpFile, err := ioutil.TempFile(cacheDir, "remote.")
+	if err != nil {
+		log.WithFields(log.Fields{"cacheDir": cacheDir, "Error": err}).Error("Revelo: Cannot create tmp file")
+		return false, err
+	}
+	tmpName := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpName)
+
+	err = acc.GetFile(remoteName, tmpName)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	log.WithFields(log.Fields{"Remote": remoteName, "Error": err}).Error("Revelo: Cannot get remote file")
+	return false, err
+}
+
+// Local versions not in remote, oldest first
+func pendingVersions(remote *horcrux.Meta, locals []*horcrux.Meta) ([]*horcrux.Meta, error) {
+	remoteNum, err := horcrux.VerNum(remote.CurrVer)
+	if err != nil {
+		log.WithFields(log.Fields{"Version": remote.CurrVer}).Error("Push: Invalid remote version")
+		return nil, syscall.EINVAL
+	}
+
+	var pending []*horcrux.Meta
+	parent := remote.CurrVer
+	for _, Meta := range locals {
+		verNum, _ := horcrux.VerNum(Meta.CurrVer)
+
+		if verNum == remoteNum && !sameVersion(Meta.Version(), remote.Version()) {
+			log.WithFields(log.Fields{"Version": Meta.CurrVer}).Error("Push: Remote has a different version")
+			return nil, ErrConflict
+		}
+
+		if verNum <= remoteNum {
+			continue
+		}
+
+		if Meta.Version().Parent != parent {
+			log.WithFields(log.Fields{
+				"Version": Meta.CurrVer,
+				"Parent":  Meta.Version().Parent,
+				"Remote":  parent,
+			}).Error("Push: Version not made from remote latest")
+			return nil, ErrConflict
+		}
+
+		pending = append(pending, Meta)
+		parent = Meta.CurrVer
+	}
+
+	return pending, nil
+}
+
+// Same commit - versions are never changed after commit
+func sameVersion(a *horcrux.Version, b *horcrux.Version) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Gets remote latest meta
+func getRemoteMeta(acc accio.Access, remoteDir string, Name string, key []byte, cacheDir string) (*horcrux.Meta, error) {
+	return getRemoteFile(acc, remotePath(remoteDir, Name+".meta"), key, cacheDir)
+}
+
+// Gets remote meta file remoteName
+func getRemoteFile(acc accio.Access, remoteName string, key []byte, cacheDir string) (*horcrux.Meta, error) {
+	tmpFile, err := ioutil.TempFile(cacheDir, "remote.")
+	if err != nil {
+		log.WithFields(log.Fields{"cacheDir": cacheDir, "Error": err}).Error("Revelo: Cannot create tmp file")
+		return nil, err
+	}
+	tmpName := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpName)
+
+	if err := acc.GetFile(remoteName, tmpName); err != nil {
+		log.WithFields(log.Fields{"Remote": remoteName, "Error": err}).Error("Revelo: Cannot get remote meta")
+		return nil, err
+	}
+
+	return readMeta(tmpName, key)
+}
+
+// Encodes chunk with hash from local chunk store and uploads it
+func pushChunk(acc accio.Access, c *codec.Codec, remoteDir string, cacheDir string, hash string) error {
+	cacheName := cacheDir + "/" + horcrux.ChunkPath(hash)
+
+	data, err := ioutil.ReadFile(cacheName)
+	if err != nil {
+		log.WithFields(log.Fields{"cacheName": cacheName, "Error": err}).Error("Push: Cannot read chunk")
+		return err
+	}
+
+	data, err = c.Encode(hash, data)
+	if err != nil {
+		log.WithFields(log.Fields{"Hash": hash, "Error": err}).Error("Push: Cannot encode chunk")
+		return err
+	}
+
+	return putData(acc, data, remotePath(remoteDir, horcrux.ChunkPath(hash)), cacheDir)
+}
+
+// Uploads Meta to remoteName - encrypted with key, if horcrux is encrypted
+func putMeta(acc accio.Access, key []byte, Meta *horcrux.Meta, remoteName string, cacheDir string) error {
+	js, err := json.MarshalIndent(Meta, "", "    ")
+	if err != nil {
+		log.WithFields(log.Fields{"Version": Meta.CurrVer, "Error": err}).Error("Push: Cannot marshal meta")
+		return err
+	}
+
+	if Meta.Config.Encryption != "" {
+		js, err = codec.SealMeta(key, js)
+		if err != nil {
+			log.WithFields(log.Fields{"Version": Meta.CurrVer, "Error": err}).Error("Push: Cannot encrypt meta")
+			return err
+		}
+	}
+
+	return putData(acc, js, remoteName, cacheDir)
+}
+
+// Uploads data to remoteName, through a tmp file in cacheDir
+func putData(acc accio.Access, data []byte, remoteName string, cacheDir string) error {
+	tmpFile, err := ioutil.TempFile(cacheDir, "push.")
+	if err != nil {
+		log.WithFields(log.Fields{"cacheDir": cacheDir, "Error": err}).Error("Push: Cannot create tmp file")
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if err != nil {
+		log.WithFields(log.Fields{"tmpName": tmpName, "Error": err}).Error("Push: Cannot write tmp file")
+		return err
+	}
+
+	if err := acc.PutFile(tmpName, remoteName); err != nil {
+		log.WithFields(log.Fields{"Remote": remoteName, "Error": err}).Error("Push: Cannot put file")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,309 @@
+//
+// Refs - names for versions (ex: prod-2026-10-01), kept in remote <name>.refs
+//  - Tags are set once, and moved only if forced
+//  - Branches are moved freely (ex: a team's dataset, moved to newer versions
+//    as they are pushed)
+//  - Tags and branches share the names, and names never look like versions (vN)
+//  - Refs file is encrypted like the meta, if the horcrux is
+//  - mount takes a ref in place of a version
+//  - Refs are written only if the remote refs are as they were read, else
+//    ErrConflict - set or delete again
+//
+
+package revelo
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/accio"
+	"github.com/muthu-r/horcrux/codec"
+)
+
+// Ref kinds
+const (
+	REF_TAG    = "tag"
+	REF_BRANCH = "branch"
+)
+
+var ErrRefExists = errors.New("ref exists")
+
+type Refs struct {
+	Tags     map[string]string `json:"Tags"`     // Name -> version
+	Branches map[string]string `json:"Branches"` // Name -> version
+
+	read *Refs // As got from remote, to check it was not changed before put
+}
+
+var refNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Version ref points to, "" if there is no such ref
+func (r *Refs) Lookup(ref string) string {
+	if ver, ok := r.Tags[ref]; ok {
+		return ver
+	}
+	return r.Branches[ref]
+}
+
+// Refs of kind
+func (r *Refs) kind(kind string) (map[string]string, error) {
+	switch kind {
+	case REF_TAG:
+		return r.Tags, nil
+	case REF_BRANCH:
+		return r.Branches, nil
+	}
+
+	log.Errorf("Refs: Invalid ref kind %v", kind)
+	return nil, syscall.EINVAL
+}
+
+// Refs of horcrux Name at accType
+func ListRefs(Name string, accType string, key []byte, cacheDir string) (*Refs, error) {
+	acc, remoteDir, err := remoteAccess(accType)
+	if err != nil {
+		return nil, err
+	}
+
+	return getRefs(acc, remoteDir, Name, key, cacheDir)
+}
+
+// Points ref of kind to version ver (or ref), latest if empty
+// Existing tag is moved only if force is set, branches always are
+// Returns the version ref points to
+func SetRef(Name string, accType string, key []byte, cacheDir string, kind string, ref string, ver string, force bool) (string, error) {
+	if !refNameRe.MatchString(ref) {
+		log.WithFields(log.Fields{"Ref": ref}).Error("Refs: Invalid ref name")
+		return "", syscall.EINVAL
+	}
+	if _, err := horcrux.VerNum(ref); err == nil {
+		log.WithFields(log.Fields{"Ref": ref}).Error("Refs: Ref name cannot be a version")
+		return "", syscall.EINVAL
+	}
+
+	acc, remoteDir, err := remoteAccess(accType)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := getRemoteMeta(acc, remoteDir, Name, key, cacheDir)
+	if err != nil {
+		return "", err
+	}
+
+	refs, err := getRefs(acc, remoteDir, Name, key, cacheDir)
+	if err != nil {
+		return "", err
+	}
+
+	refMap, err := refs.kind(kind)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case ver == "":
+		ver = head.CurrVer
+	case refs.Lookup(ver) != "":
+		ver = refs.Lookup(ver)
+	}
+
+	// Has to be there
+	_, err = getRemoteFile(acc, remotePath(remoteDir, horcrux.VerMetaPath(ver, Name)), key, cacheDir)
+	if err != nil {
+		log.WithFields(log.Fields{"Version": ver, "Error": err}).Error("Refs: No such version")
+		return "", err
+	}
+
+	if old := refs.Lookup(ref); old != "" {
+		if _, same := refMap[ref]; !same {
+			log.WithFields(log.Fields{"Ref": ref}).Error("Refs: Name used by other kind of ref")
+			return "", ErrRefExists
+		}
+		if kind == REF_TAG && !force && old != ver {
+			log.WithFields(log.Fields{"Tag": ref, "Version": old}).Error("Refs: Tag exists, not moving it")
+			return "", ErrRefExists
+		}
+	}
+
+	refMap[ref] = ver
+	if err := putRefs(acc, remoteDir, Name, key, head.Config, refs, cacheDir); err != nil {
+		return "", err
+	}
+
+	log.WithFields(log.Fields{"Kind": kind, "Ref": ref, "Version": ver}).Info("Refs: Set")
+	return ver, nil
+}
+
+// Removes ref of kind
+func DeleteRef(Name string, accType string, key []byte, cacheDir string, kind string, ref string) error {
+	acc, remoteDir, err := remoteAccess(accType)
+	if err != nil {
+		return err
+	}
+
+	head, err := getRemoteMeta(acc, remoteDir, Name, key, cacheDir)
+	if err != nil {
+		return err
+	}
+
+	refs, err := getRefs(acc, remoteDir, Name, key, cacheDir)
+	if err != nil {
+		return err
+	}
+
+	refMap, err := refs.kind(kind)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := refMap[ref]; !ok {
+		log.WithFields(log.Fields{"Kind": kind, "Ref": ref}).Error("Refs: No such ref")
+		return syscall.ENOENT
+	}
+
+	delete(refMap, ref)
+	return putRefs(acc, remoteDir, Name, key, head.Config, refs, cacheDir)
+}
+
+// Version for ver - a version or a ref of horcrux Name
+func resolveVersion(acc accio.Access, remoteDir string, Name string, key []byte, cacheDir string, ver string) (string, error) {
+	if _, err := horcrux.VerNum(ver); err == nil {
+		return ver, nil
+	}
+
+	refs, err := getRefs(acc, remoteDir, Name, key, cacheDir)
+	if err != nil {
+		return "", err
+	}
+
+	refVer := refs.Lookup(ver)
+	if refVer == "" {
+		log.WithFields(log.Fields{"Ref": ver}).Error("Revelo: No such version or ref")
+		return "", syscall.ENOENT
+	}
+
+	log.WithFields(log.Fields{"Ref": ver, "Version": refVer}).Info("Revelo: Ref resolved")
+	return refVer, nil
+}
+
+// Remote access for accType, and its top dir
+func remoteAccess(accType string) (accio.Access, string, error) {
+	acc, err := initAccess(accType, "")
+	if err != nil {
+		log.Errorf("Revelo: Invalid Access type: %v", accType)
+		return nil, "", err
+	}
+
+	remoteDir, err := acc.Init()
+	if err != nil {
+		log.WithFields(log.Fields{"Acc": acc, "Error": err}).Error("Revelo: Cannot init access")
+		return nil, "", err
+	}
+
+	return acc, remoteDir, nil
+}
+
+// Gets remote refs - none, if there is no refs file yet
+func getRefs(acc accio.Access, remoteDir string, Name string, key []byte, cacheDir string) (*Refs, error) {
+	refs := &Refs{Tags: make(map[string]string), Branches: make(map[string]string)}
+
+	tmpFile, err := ioutil.TempFile(cacheDir, "refs.")
+	if err != nil {
+		log.WithFields(log.Fields{"cacheDir": cacheDir, "Error": err}).Error("Refs: Cannot create tmp file")
+		return nil, err
+	}
+	tmpName := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpName)
+
+	remoteName := remotePath(remoteDir, Name+".refs")
+	if err := acc.GetFile(remoteName, tmpName); err != nil {
+		if os.IsNotExist(err) {
+			refs.read = refs.copy()
+			return refs, nil
+		}
+		log.WithFields(log.Fields{"Remote": remoteName, "Error": err}).Error("Refs: Cannot get refs")
+		return nil, err
+	}
+
+	js, err := ioutil.ReadFile(tmpName)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err = codec.OpenMeta(key, js)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(js, refs); err != nil {
+		log.WithFields(log.Fields{"Remote": remoteName, "Error": err}).Error("Refs: Cannot unmarshal refs")
+		return nil, err
+	}
+
+	// Missing in file
+	if refs.Tags == nil {
+		refs.Tags = make(map[string]string)
+	}
+	if refs.Branches == nil {
+		refs.Branches = make(map[string]string)
+	}
+	refs.read = refs.copy()
+	return refs, nil
+}
+
+func (r *Refs) copy() *Refs {
+	c := &Refs{Tags: make(map[string]string), Branches: make(map[string]string)}
+	for ref, ver := range r.Tags {
+		c.Tags[ref] = ver
+	}
+	for ref, ver := range r.Branches {
+		c.Branches[ref] = ver
+	}
+	return c
+}
+
+// Are r and o the same refs
+func (r *Refs) same(o *Refs) bool {
+	return reflect.DeepEqual(r.Tags, o.Tags) && reflect.DeepEqual(r.Branches, o.Branches)
+}
+
+// Uploads refs - encrypted with key, if horcrux is encrypted (cfg)
+// Fails with ErrConflict if remote refs changed since refs were got
+// (getRefs) - a small window from the check to the put remains
+func putRefs(acc accio.Access, remoteDir string, Name string, key []byte, cfg horcrux.Config, refs *Refs, cacheDir string) error {
+	curr, err := getRefs(acc, remoteDir, Name, key, cacheDir)
+	if err != nil {
+		return err
+	}
+
+	if refs.read == nil || !curr.same(refs.read) {
+		log.WithFields(log.Fields{"Name": Name}).Error("Refs: Remote refs changed, not writing refs")
+		return ErrConflict
+	}
+
+	js, err := json.MarshalIndent(refs, "", "    ")
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Refs: Cannot marshal refs")
+		return err
+	}
+
+	if cfg.Encryption != "" {
+		js, err = codec.SealMeta(key, js)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err}).Error("Refs: Cannot encrypt refs")
+			return err
+		}
+	}
+
+	return putData(acc, js, remotePath(remoteDir, Name+".refs"), cacheDir)
+}
@@ -0,0 +1,83 @@
+package revelo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/codec"
+)
+
+var remoteKey = []byte("0123456789abcdef0123456789abcdef")
+
+// Remote with T.meta and T.refs as given, and a cache dir
+func testRemote(t *testing.T, meta []byte, refs []byte) (string, string) {
+	dir, err := ioutil.TempDir("", "revelo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir+"/cache", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/T.meta", meta, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/T.refs", refs, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir, dir + "/cache"
+}
+
+func TestRemoteNotEncrypted(t *testing.T) {
+	M := &horcrux.Meta{CurrVer: "v1", Entries: []horcrux.Entry{
+		{Name: "T", IsDir: true, Stat: horcrux.Stat{Mode: os.ModeDir | 0755}},
+	}}
+	M.Root = horcrux.RootHash(M)
+	metaJs, _ := json.Marshal(M)
+	refsJs, _ := json.Marshal(&Refs{Tags: map[string]string{"rel": "v1"}})
+
+	sealedMeta, err := codec.SealMeta(remoteKey, metaJs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedRefs, err := codec.SealMeta(remoteKey, refsJs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remotes := map[string][2][]byte{
+		"sealed":         {sealedMeta, sealedRefs},
+		"magic stripped": {sealedMeta[len(codec.META_MAGIC):], sealedRefs[len(codec.META_MAGIC):]},
+		"plain":          {metaJs, refsJs},
+	}
+	for name, files := range remotes {
+		dir, cacheDir := testRemote(t, files[0], files[1])
+		defer os.RemoveAll(dir)
+
+		acc, err := initAccess("cp://"+dir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		remoteDir, err := acc.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, metaErr := getRemoteFile(acc, remotePath(remoteDir, "T.meta"), remoteKey, cacheDir)
+		_, refsErr := getRefs(acc, remoteDir, "T", remoteKey, cacheDir)
+		if name == "sealed" {
+			if metaErr != nil || refsErr != nil {
+				t.Errorf("%v: meta %v, refs %v", name, metaErr, refsErr)
+			}
+			continue
+		}
+		if metaErr == nil || refsErr == nil {
+			t.Errorf("%v: meta %v, refs %v", name, metaErr, refsErr)
+		}
+		if name == "plain" && (metaErr != codec.ErrNotEncrypted || refsErr != codec.ErrNotEncrypted) {
+			t.Errorf("%v: meta %v, refs %v", name, metaErr, refsErr)
+		}
+	}
+}
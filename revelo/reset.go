@@ -0,0 +1,259 @@
+//
+// Reset - drops local changes of a mount, back to its base version (see status.go)
+//  - Whole horcrux, or only the given paths (files or dirs)
+//  - Dirty chunks of the reset files are removed. Clean chunks stay in
+//    the cache, they are same in the base version - no need to get again.
+//  - Files open during reset see the base version only when opened again
+//
+
+package revelo
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/revelo/dirTree"
+)
+
+// Resets paths of horcrux mounted at mntDir to its base version, all if no paths
+// Paths are below the horcrux root, or absolute below mntDir
+// Returns the changes dropped
+func Reset(mntDir string, paths []string) ([]Change, error) {
+	data, err := getMount(mntDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return reset(data, paths)
+}
+
+func reset(data *ReveloData, paths []string) ([]Change, error) {
+	if data.readOnly {
+		return nil, syscall.EROFS
+	}
+
+	var names []string
+	for _, p := range paths {
+		name, err := resetPath(data, p)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			// Root - same as all
+			names = nil
+			break
+		}
+		names = append(names, name)
+	}
+
+	selected := func(name string) bool {
+		if len(names) == 0 {
+			return true
+		}
+		for _, n := range names {
+			if name == n || strings.HasPrefix(name, n+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	// No writes till we are done
+	data.commitLock.Lock()
+	defer data.commitLock.Unlock()
+
+	base, err := readMeta(baseName(data), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// To tell what is dropped - not needed to reset
+	all, err := status(data)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Warn("Reset: Cannot get changes")
+	}
+
+	var changes []Change
+	for _, ch := range all {
+		if selected(ch.Path) {
+			changes = append(changes, ch)
+		}
+	}
+
+	data.lock.RLock()
+	Meta, err := dirTree.GetMeta(data.Root)
+	data.lock.RUnlock()
+
+	if err != nil {
+		log.Error("Reset: Cannot get Meta data")
+		return nil, err
+	}
+
+	Meta.Entries = resetEntries(base, Meta, len(names) == 0, selected)
+
+	data.lock.Lock()
+	setInodes(data, Meta)
+	data.lock.Unlock()
+
+	root, err := dirTree.Create(Meta)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Reset: Cannot create dirTree")
+		return nil, err
+	}
+
+	data.lock.Lock()
+	data.Root = root
+	setLinks(data, root, Meta)
+	data.NumFiles = len(Meta.Entries)
+	data.lock.Unlock()
+
+	if len(names) == 0 {
+		err = os.RemoveAll(data.workDir + "/" + CACHE_DIRTYDIR)
+	} else {
+		for _, name := range names {
+			if err = removeDirty(data, name); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Reset: Cannot remove dirty chunks")
+		return nil, err
+	}
+
+	if err := saveMeta(data); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"Version": data.CurrVer,
+		"Paths":   names,
+		"Changes": len(changes),
+	}).Info("Reset: Done")
+	return changes, nil
+}
+
+// Path p below the horcrux root, "" for the root
+func resetPath(data *ReveloData, p string) (string, error) {
+	if filepath.IsAbs(p) {
+		rel, err := filepath.Rel(data.mntDir, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			log.WithFields(log.Fields{"Path": p, "mntDir": data.mntDir}).Error("Reset: Path not in mount")
+			return "", syscall.EINVAL
+		}
+		p = rel
+	}
+
+	p = path.Clean(p)
+	if p == ".." || strings.HasPrefix(p, "../") {
+		log.WithFields(log.Fields{"Path": p}).Error("Reset: Path not in horcrux")
+		return "", syscall.EINVAL
+	}
+
+	if p == "." {
+		return "", nil
+	}
+	return p, nil
+}
+
+// Entries of Meta, with the selected ones from base instead
+func resetEntries(base *horcrux.Meta, Meta *horcrux.Meta, all bool, selected func(string) bool) []horcrux.Entry {
+	root := Meta.Entries[0]
+	if all {
+		root = base.Entries[0]
+	}
+
+	baseEntries := make(map[string]*horcrux.Entry)
+	for i := 1; i < len(base.Entries); i++ {
+		baseEntries[entryPath(&base.Entries[i])] = &base.Entries[i]
+	}
+
+	entries := make(map[string]horcrux.Entry)
+	for i := 1; i < len(Meta.Entries); i++ {
+		name := entryPath(&Meta.Entries[i])
+		if !selected(name) {
+			entries[name] = Meta.Entries[i]
+		}
+	}
+
+	for name, entry := range baseEntries {
+		if !selected(name) {
+			continue
+		}
+		entries[name] = *entry
+
+		// Parent dirs removed locally come back too
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := entries[dir]; ok {
+				break
+			}
+			if parent, ok := baseEntries[dir]; ok {
+				entries[dir] = *parent
+			}
+		}
+	}
+
+	return treeEntries(root, entries)
+}
+
+// Entries with root first, and parent dirs before their kids - as
+// dirTree.Create needs. entries are by path below root.
+func treeEntries(root horcrux.Entry, entries map[string]horcrux.Entry) []horcrux.Entry {
+	list := make([]horcrux.Entry, 0, len(entries)+1)
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		ni, nj := entryPath(&list[i]), entryPath(&list[j])
+		di, dj := strings.Count(ni, "/"), strings.Count(nj, "/")
+		if di != dj {
+			return di < dj
+		}
+		return ni < nj
+	})
+
+	return append([]horcrux.Entry{root}, list...)
+}
+
+// Removes dirty chunks of name - a file or a dir
+func removeDirty(data *ReveloData, name string) error {
+	dirtyName := data.workDir + "/" + CACHE_DIRTYDIR + "/" + name
+
+	if err := os.RemoveAll(dirtyName); err != nil {
+		return err
+	}
+
+	// Chunks of file name are <name>.<idx>
+	files, err := ioutil.ReadDir(path.Dir(dirtyName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	prefix := path.Base(dirtyName) + "."
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), prefix) || fi.IsDir() {
+			continue
+		}
+		if _, err := strconv.ParseInt(fi.Name()[len(prefix):], 10, 64); err != nil {
+			continue
+		}
+		if err := os.Remove(path.Dir(dirtyName) + "/" + fi.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
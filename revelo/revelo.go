@@ -1,23 +1,26 @@
 //
 // TODO:
-// 1. Preserve FILE, HANDLE across lookup, open, create
-// 	- Need this to support O_EXCL and other semantics
-// 	- Multiple simul access is not handled properly
-// 2. Sparse files not supported
-// 3. Attr FLOCK
-// 4. saveMeta - delay saving to absorb multiple changes
+// 1. Sparse files not supported
+// 2. Attr FLOCK
+// 3. saveMeta - delay saving to absorb multiple changes
 
 package revelo
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -27,6 +30,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/codec"
 	"github.com/muthu-r/horcrux/revelo/dirTree"
 
 	"github.com/muthu-r/horcrux/accio"
@@ -41,25 +45,115 @@ type ReveloData struct {
 	Config   horcrux.Config
 	NumFiles int
 	CurrVer  string
+	History  []horcrux.Version
 
-	metaName string // Name of the meta file - input to revelo
+	name     string // Horcrux name - input to revelo
+	metaName string // Name of the meta file
 
 	Root *dirTree.Node // DirTree for FS ops
 	lock sync.RWMutex  // Lock for the tree
 
-	cacheDir string
-	mntDir   string
-	fuseConn *fuse.Conn
+	// Held (R) by ops changing files, (W) by commit for a consistent snapshot
+	commitLock sync.RWMutex
+
+	codec *codec.Codec // Decodes chunks got from remote
+	acc   accio.Access // For remote metas after mount (pull)
+	key   []byte
+
+	verify  string              // VERIFY_*, of remote metas
+	trusted []ed25519.PublicKey // Keys remote metas can be signed by
+
+	remoteDir string
+	cacheDir  string
+	workDir   string // Working meta and dirty chunks - cacheDir, or CACHE_VERDIR/<ver> for a version
+	mntDir    string
+	readOnly  bool
+	pinned    bool // Mounted a version, not the latest
+	fuseConn  *fuse.Conn
+
+	// Versions under SNAP_DIR, by version (see snapshot.go)
+	snapshot bool // This is one
+	snaps    map[string]*ReveloData
+	snapLock sync.Mutex
+
+	// Remote versions, listed for len(History) records - under snapLock
+	remoteVers    map[string]bool
+	remoteVersLen int
+
+	// FILE and DIR the kernel has, by inode (see node.go)
+	nodes    map[uint64]fs.Node
+	nodeLock sync.Mutex
+	nextIno  uint64 // For new entries, under lock
+
+	// Files with hard links, by inode (see link.go) - under lock
+	links map[uint64]*fileLinks
+}
+
+// Signature checks of remote metas (see codec/sign.go)
+//  - "" is VERIFY_WARN if there are trusted keys, VERIFY_OFF if not
+const (
+	VERIFY_OFF     = "off"
+	VERIFY_WARN    = "warn"    // Mount, with a warning
+	VERIFY_REQUIRE = "require" // Dont mount
+)
+
+var ErrBaseChanged = errors.New("local base meta is not the remote version it was mounted from")
+
+// Mount options
+type MountOpts struct {
+	Version  string // Version to mount (vN), latest if empty
+	ReadOnly bool
+	Verify   string              // VERIFY_*
+	Trusted  []ed25519.PublicKey // Trusted sign keys
+}
+
+// Mounts in this process, by mount dir
+var mounts = struct {
+	sync.Mutex
+	m map[string]*ReveloData
+}{m: make(map[string]*ReveloData)}
+
+// Mount data for mntDir, if its mounted in this process
+func getMount(mntDir string) (*ReveloData, error) {
+	mntDir, err := filepath.Abs(mntDir)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts.Lock()
+	defer mounts.Unlock()
+
+	data, ok := mounts.m[mntDir]
+	if !ok {
+		log.WithFields(log.Fields{"mntDir": mntDir}).Error("Revelo: Not mounted")
+		return nil, syscall.ENOENT
+	}
+	return data, nil
 }
 
-var GlobalData ReveloData
+// Local cache layout (in cacheDir)
+//  - <name>.meta: working meta, with local changes
+//  - <name>.base.meta: meta of the version the working meta is from (see status.go)
+//  - horcrux.CHUNKDIR: clean chunks got from remote, by hash (same as remote)
+//  - CACHE_DIRTYDIR: locally modified chunks, by file path and chunk index
+//  - CACHE_COMMITDIR: local versions (see commit.go), by horcrux.VerMetaPath
+//  - CACHE_VERDIR/<ver>: working meta and CACHE_DIRTYDIR of a mounted
+//    older version - same as the above for the latest
+//  - CTL_SOCK: control socket of the mount (see ctl.go), next to the working meta
+const (
+	CACHE_DIRTYDIR  = "dirty"
+	CACHE_COMMITDIR = "commits"
+	CACHE_VERDIR    = "versions"
+)
+
+// Times to try getting a chunk from remote, before failing with EIO
+const FETCH_RETRIES = 3
 
 const Usage =   "revelo <name> <access-type> <mnt-dir>\n" +
 		"            access-type is one of:\n" +
 		"                cp://<local-dir>\n" +
 		"                scp://user::passwd@host:/path\n" +
-		"                s3://bucket@region (credentials in ~/.aws/credentials)\n" +
-		"                minio://host:port/bucket (credentials in ~/.minio/horcrux.json)\n"
+		"                s3://bucket@region (credentials in ~/.aws/credentials)\n"
 
 // Given a string <accType>://<args>, it returns accType, args
 func getAccessType(acc string) (string, string) {
@@ -121,13 +215,21 @@ func initAccess(accType string, mntDir string) (accio.Access, error) {
 // Main function.
 //  - Exposes remote FS structure locally using FUSE (bazil-fuse)
 //  - Gets files from remote on-demand
-//  - TODO:
-//	- Check-in files to remote
-//	- Version control
+//  - Local changes can be committed to local versions (see commit.go),
+//    and pushed to remote (see push.go)
+//  - opts.Version mounts an older version, or the version of a ref
 //
-func Revelo(Name string, accType string, cacheDir string, mntDir string) error {
+func Revelo(Name string, accType string, key []byte, cacheDir string, mntDir string, opts MountOpts) error {
+
+	data := &ReveloData{name: Name, metaName: Name + ".meta", readOnly: opts.ReadOnly, pinned: opts.Version != "", key: key,
+		verify: opts.Verify, trusted: opts.Trusted}
+	switch opts.Verify {
+	case "", VERIFY_OFF, VERIFY_WARN, VERIFY_REQUIRE:
+	default:
+		log.Errorf("Revelo: Invalid verify option: %v", opts.Verify)
+		return syscall.EINVAL
+	}
 
-	GlobalData.metaName = Name + ".meta"
 	acc, err := initAccess(accType, mntDir)
 	if err != nil {
 		log.Errorf("Revelo: Invalid Access type: %v", accType)
@@ -140,17 +242,171 @@ func Revelo(Name string, accType string, cacheDir string, mntDir string) error {
 		return err
 	}
 
-	GlobalData.cacheDir = cacheDir
-	GlobalData.mntDir = mntDir
+	data.acc = acc
+	data.remoteDir = remoteDir
+	data.cacheDir = cacheDir
+	data.workDir = cacheDir
+	data.mntDir, err = filepath.Abs(mntDir)
+	if err != nil {
+		return err
+	}
+
+	if opts.Version != "" {
+		// Tag or branch (see refs.go)
+		opts.Version, err = resolveVersion(acc, data.remoteDir, data.name, key, data.cacheDir, opts.Version)
+		if err != nil {
+			return err
+		}
+
+		data.workDir = cacheDir + "/" + CACHE_VERDIR + "/" + opts.Version
+		if err := os.MkdirAll(data.workDir, 0700); err != nil {
+			log.WithFields(log.Fields{"Dir": data.workDir, "Error": err}).Error("Revelo: Cannot create version dir")
+			return err
+		}
+	}
 
 	log.WithFields(log.Fields{
 		"Access":    acc,
 		"CacheDir":  cacheDir,
 		"mntDir":    mntDir,
 		"RemoteDir": remoteDir,
+		"Version":   opts.Version,
+		"ReadOnly":  opts.ReadOnly,
 	}).Info("Revelo - Init done...")
 
-	_, err = os.Stat(cacheDir + "/" + GlobalData.metaName)
+	meta, err := loadMeta(acc, data, opts, key)
+	if err != nil {
+		return err
+	}
+
+	if err := checkMeta(meta); err != nil {
+		return err
+	}
+
+	// Before anything is built from it
+	if err := verifyBase(acc, data, meta.CurrVer, key); err != nil {
+		return err
+	}
+
+	// Fails for wrong or missing key - better now than garbage reads later
+	data.codec, err = codec.New(meta.Config, key)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Revelo: Cannot init codec")
+		return err
+	}
+
+	// Create dirTree
+	setInodes(data, meta)
+	data.Root, err = dirTree.Create(meta)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Revelo: Cannot create dirTree")
+		return err
+	}
+	setLinks(data, data.Root, meta)
+	data.Config = meta.Config
+	data.CurrVer = meta.CurrVer
+	data.History = meta.History
+	data.NumFiles = meta.NumFiles
+
+	// Mount local
+	mntOpts := []fuse.MountOption{
+		fuse.FSName("Horcrux"),
+		fuse.Subtype("Horcrux-"+acc.Name()),
+		fuse.MaxReadahead(128 * (1 << 10)),
+		fuse.AllowOther()} //XXX : Revisit AllowOther
+	if opts.ReadOnly {
+		mntOpts = append(mntOpts, fuse.ReadOnly())
+	}
+
+	fuseConn, err := fuse.Mount(mntDir, mntOpts...)
+	
+    if err != nil {
+		log.WithFields(log.Fields{"Conn": fuseConn, "Error": err}).Error("Mount Failed")
+		return err
+	}
+
+	defer fuseConn.Close()
+
+	data.fuseConn = fuseConn
+
+	log.Debugf("Mount OK: %v", data.CurrVer)
+
+	mounts.Lock()
+	mounts.m[data.mntDir] = data
+	mounts.Unlock()
+
+	defer func() {
+		mounts.Lock()
+		delete(mounts.m, data.mntDir)
+		mounts.Unlock()
+	}()
+
+	// For horcrux-cli commands on this mount
+	ctl, err := serveCtl(data)
+	if err != nil {
+		return err
+	}
+	defer ctl.Close()
+
+	horcruxFS := &FS{Acc: &acc, RData: data, remoteDir: remoteDir, cacheDir: data.workDir}
+
+	err = fs.Serve(fuseConn, horcruxFS)
+	if err != nil {
+		log.WithFields(log.Fields{"Conn": fuseConn, "Error": err}).Error("Cannot fs.Serve")
+		return err
+	}
+
+	<-fuseConn.Ready
+
+	if err := fuseConn.MountError; err != nil {
+		log.WithFields(log.Fields{"Conn": fuseConn, "Error": err}).Error("Mount Failed")
+		return err
+	}
+
+	log.Info("Revelo Done...")
+	return nil
+}
+
+// Gets the meta to mount
+//  - Latest: working meta in cacheDir, got from remote <name>.meta the first time
+//  - opts.Version: working meta in workDir, from the version meta the first time.
+//    Read only mounts use the version meta as is.
+//  - Base meta (see status.go) is saved along with a new working meta
+func loadMeta(acc accio.Access, data *ReveloData, opts MountOpts, key []byte) (*horcrux.Meta, error) {
+	workMeta := data.workDir + "/" + data.metaName
+
+	if opts.Version != "" {
+		if opts.ReadOnly {
+			meta, err := versionMeta(acc, data, opts.Version, key)
+			if err != nil {
+				return nil, err
+			}
+			return meta, writeBase(data, meta)
+		}
+
+		if _, err := os.Stat(workMeta); err == nil {
+			log.Info("Revelo: Meta file present, using it...")
+			return readWorkMeta(acc, data, key)
+		}
+
+		meta, err := versionMeta(acc, data, opts.Version, key)
+		if err != nil {
+			return nil, err
+		}
+
+		js, err := json.MarshalIndent(meta, "", "    ")
+		if err == nil {
+			err = ioutil.WriteFile(workMeta, js, 0600)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"Meta File": workMeta, "Error": err}).Error("Revelo: Cannot create working meta")
+			return nil, err
+		}
+
+		return meta, writeBase(data, meta)
+	}
+
+	_, err := os.Stat(workMeta)
 
 	// If some error happened here, we might fail in open later.
 	// Its better not to GetFile in that case.
@@ -158,32 +414,85 @@ func Revelo(Name string, accType string, cacheDir string, mntDir string) error {
 	// Get meta from <name>.meta file
 	metaPresent := ((err == nil) || !os.IsNotExist(err))
 	if metaPresent == false {
-		var metaName string
-		if remoteDir == "" {
-			metaName = GlobalData.metaName
-		} else {
-			metaName = remoteDir + "/" + GlobalData.metaName
-		}
-		err = acc.GetFile(metaName, cacheDir+"/"+GlobalData.metaName)
+		metaName := remotePath(data.remoteDir, data.metaName)
+		err = acc.GetFile(metaName, workMeta)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"Remote":  metaName,
-				"Local":   cacheDir + "/" + GlobalData.metaName,
+				"Local":   workMeta,
 				"AccData": acc,
 			}).Error("Revelo: Cannot get meta file")
-			return err
+			return nil, err
 		}
-	} else {
-		log.Info("Revelo: Meta file present, using it...")
+
+		meta, err := readMeta(workMeta, key)
+		if err != nil {
+			return nil, err
+		}
+		return meta, writeBase(data, meta)
+	}
+
+	log.Info("Revelo: Meta file present, using it...")
+	return readWorkMeta(acc, data, key)
+}
+
+// Reads working meta kept from an earlier mount
+// Caches from before base meta was kept get it from the version meta
+func readWorkMeta(acc accio.Access, data *ReveloData, key []byte) (*horcrux.Meta, error) {
+	meta, err := readLocalMeta(data.workDir+"/"+data.metaName, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(baseName(data)); err == nil {
+		return meta, nil
+	}
+
+	base, err := versionMeta(acc, data, meta.CurrVer, key)
+	if err != nil {
+		// Only status is not possible
+		log.WithFields(log.Fields{"Version": meta.CurrVer, "Error": err}).Warn("Revelo: Cannot get base meta")
+		return meta, nil
+	}
+
+	return meta, writeBase(data, base)
+}
+
+// Meta of version ver - from local versions, or remote
+func versionMeta(acc accio.Access, data *ReveloData, ver string, key []byte) (*horcrux.Meta, error) {
+	if _, err := horcrux.VerNum(ver); err != nil {
+		log.WithFields(log.Fields{"Version": ver}).Error("Revelo: Invalid version")
+		return nil, syscall.EINVAL
 	}
 
-	metaFile, err := os.Open(cacheDir + "/" + GlobalData.metaName)
+	localName := versionName(data.cacheDir, data.name, ver)
+	if _, err := os.Stat(localName); err == nil {
+		return readMeta(localName, nil)
+	}
+
+	return getRemoteFile(acc, remotePath(data.remoteDir, horcrux.VerMetaPath(ver, data.name)), key, data.cacheDir)
+}
+
+// Reads meta from file - decrypted with key, if its encrypted
+//  - With a key, meta has to be encrypted, as it is on remote
+func readMeta(name string, key []byte) (*horcrux.Meta, error) {
+	return readMetaFile(name, key, false)
+}
+
+// Reads working meta from file
+//  - Its saved in plain, or still as got from remote
+func readLocalMeta(name string, key []byte) (*horcrux.Meta, error) {
+	return readMetaFile(name, key, true)
+}
+
+func readMetaFile(name string, key []byte, local bool) (*horcrux.Meta, error) {
+	metaFile, err := os.Open(name)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"Meta File": cacheDir + "/" + GlobalData.metaName,
+			"Meta File": name,
 			"Error":     err,
 		}).Error("Cannot open meta file")
-		return err
+		return nil, err
 	}
 	defer metaFile.Close()
 
@@ -192,15 +501,26 @@ func Revelo(Name string, accType string, cacheDir string, mntDir string) error {
 	n, err := metaFile.Read(metaData)
 	if err != nil || n == 0 {
 		log.WithFields(log.Fields{
-			"Meta File":  cacheDir + "/" + GlobalData.metaName,
+			"Meta File":  name,
 			"Read bytes": n,
 			"Error":      err,
 		}).Error("Revelo: Cannot read meta file, error or empty")
-		return syscall.EINVAL
+		return nil, syscall.EINVAL
 	}
 
-	// Unmarshal the meta data
+	// Unmarshal the meta data - remote meta is encrypted with key, if horcrux is encrypted
 	metaData = metaData[:n]
+	if !local || codec.IsSealedMeta(metaData) {
+		metaData, err = codec.OpenMeta(key, metaData)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Meta File": name,
+			"Error":     err,
+		}).Error("Revelo: Cannot decrypt meta file")
+		return nil, err
+	}
+
 	meta := new(horcrux.Meta)
 	err = json.Unmarshal(metaData, meta)
 	if err != nil {
@@ -208,50 +528,20 @@ func Revelo(Name string, accType string, cacheDir string, mntDir string) error {
 			"Meta Data": string(metaData),
 			"Error":     err,
 		}).Error("Revelo: Cannot unmarshal meta data")
-		return err
-	}
-
-	// Create dirTree
-	GlobalData.Root, err = dirTree.Create(meta)
-	GlobalData.Config = meta.Config
-	GlobalData.CurrVer = meta.CurrVer
-	GlobalData.NumFiles = meta.NumFiles
-
-	// Mount local
-	fuseConn, err := fuse.Mount(mntDir,
-		fuse.FSName("Horcrux"),
-		fuse.Subtype("Horcrux-"+acc.Name()),
-		fuse.MaxReadahead(128 * (1 << 10)),
-		fuse.AllowOther()) //XXX : Revisit AllowOther
-	
-    if err != nil {
-		log.WithFields(log.Fields{"Conn": fuseConn, "Error": err}).Error("Mount Failed")
-		return err
-	}
-
-	defer fuseConn.Close()
-
-	GlobalData.fuseConn = fuseConn
-
-	log.Debugf("Mount OK: %v", GlobalData.CurrVer)
-
-	horcruxFS := &FS{Acc: &acc, RData: &GlobalData, remoteDir: remoteDir, cacheDir: cacheDir}
-
-	err = fs.Serve(fuseConn, horcruxFS)
-	if err != nil {
-		log.WithFields(log.Fields{"Conn": fuseConn, "Error": err}).Error("Cannot fs.Serve")
-		return err
+		return nil, err
 	}
 
-	<-fuseConn.Ready
-
-	if err := fuseConn.MountError; err != nil {
-		log.WithFields(log.Fields{"Conn": fuseConn, "Error": err}).Error("Mount Failed")
-		return err
+	// Tampered with, or not made by horcrux
+	if err := horcrux.CheckRoot(meta, !local); err != nil {
+		log.WithFields(log.Fields{
+			"Meta File": name,
+			"Root Hash": meta.Root,
+			"Error":     err,
+		}).Error("Revelo: Meta does not match its root hash")
+		return nil, err
 	}
 
-	log.Info("Revelo Done...")
-	return nil
+	return meta, nil
 }
 
 // Unmount local
@@ -267,7 +557,7 @@ func Unmount(mntDir string) error {
 
 //
 // FUSE implementation (check bazil-fuse for the usage)
-// TODO: Make &FILE &DIR same across multiple access.
+// FILE and DIR are same across lookups, see node.go
 type FS struct {
 	Acc   *accio.Access
 	RData *ReveloData
@@ -281,8 +571,9 @@ type DIR struct {
 	RData *ReveloData
 	Entry horcrux.Entry
 
-	remoteDir string
-	cacheDir  string
+	cacheDir string // Dirty chunks dir
+
+	lock sync.RWMutex // For Entry and cacheDir - changed by lookup and rename
 }
 
 type FILE struct {
@@ -290,16 +581,19 @@ type FILE struct {
 	RData *ReveloData
 	Entry horcrux.Entry
 
-	remoteName string
-	cacheName  string
+	cacheName string // Dirty chunks are <cacheName>.<idx>
 
 	h *HANDLE
+
+	// (W) by ops changing the file, (R) by the others. Taken before RData.lock.
+	lock sync.RWMutex
+
+	touched bool // Written since the meta was saved (see times.go)
 }
 
 type HANDLE struct {
 	Acc *accio.Access
 	f   *FILE
-	chunkSz int
 }
 
 // Updates Entry in dirTree: old -> new
@@ -327,6 +621,7 @@ func saveMeta(data *ReveloData) error {
 	Meta, err = dirTree.GetMeta(data.Root)
 	Meta.Config = data.Config
 	Meta.CurrVer = data.CurrVer
+	Meta.History = data.History
 	data.lock.RUnlock()
 
 	if err != nil {
@@ -341,7 +636,7 @@ func saveMeta(data *ReveloData) error {
 		return err
 	}
 
-	metaFile, err := os.OpenFile(data.cacheDir+"/"+data.metaName, os.O_WRONLY|os.O_SYNC, 0600)
+	metaFile, err := os.OpenFile(data.workDir+"/"+data.metaName, os.O_WRONLY|os.O_SYNC, 0600)
 	if err != nil {
 		log.WithFields(log.Fields{"Meta File": data.metaName, "Error": err}).Error("saveMeta: Cannot open meta file")
 		return err
@@ -372,17 +667,419 @@ func saveMeta(data *ReveloData) error {
 	return nil
 }
 
+//
+// Chunk geometry
+//  - Entry.ChunkOffs has the start offset of each chunk. Chunks are
+//    fixed size for CHUNK_TYPE_STATIC and variable for CHUNK_TYPE_ROLLSUM.
+//  - The last chunk can grow up to maxChunkSize, beyond that the file is
+//    extended with new maxChunkSize chunks.
+//
+
+// Max size a chunk can grow to
+func maxChunkSize(cfg horcrux.Config) int64 {
+	if cfg.ChunkType == horcrux.CHUNK_TYPE_ROLLSUM {
+		return int64(cfg.MaxChunkSize)
+	}
+	return int64(cfg.ChunkSize)
+}
+
+// Start offset of chunk idx - idx can be past the last chunk
+func chunkStart(cfg horcrux.Config, entry *horcrux.Entry, idx int64) int64 {
+	n := int64(len(entry.ChunkOffs))
+	if idx < n {
+		return entry.ChunkOffs[idx]
+	}
+
+	if n == 0 {
+		return idx * maxChunkSize(cfg)
+	}
+	return entry.ChunkOffs[n-1] + (idx-n+1)*maxChunkSize(cfg)
+}
+
+// Returns the chunk holding file offset off, and the offset within that chunk
+func findChunk(cfg horcrux.Config, entry *horcrux.Entry, off int64) (int64, int64) {
+	var idx int64
+
+	n := int64(len(entry.ChunkOffs))
+	end := chunkStart(cfg, entry, n)
+	if n > 0 && off < end {
+		idx = int64(sort.Search(int(n), func(i int) bool { return entry.ChunkOffs[i] > off })) - 1
+	} else {
+		idx = n + (off-end)/maxChunkSize(cfg)
+	}
+
+	return idx, off - chunkStart(cfg, entry, idx)
+}
+
+// Current data length of chunk idx
+func chunkLen(cfg horcrux.Config, entry *horcrux.Entry, idx int64) int64 {
+	start := chunkStart(cfg, entry, idx)
+	end := chunkStart(cfg, entry, idx+1)
+	if end > entry.Stat.Size {
+		end = entry.Stat.Size
+	}
+	if end < start {
+		return 0
+	}
+	return end - start
+}
+
+// Every file chunk needs an offset and a hash - older horcrux metas
+// have neither and have to be generated again
+func checkMeta(meta *horcrux.Meta) error {
+	for _, entry := range meta.Entries {
+		if entry.IsDir {
+			continue
+		}
+
+		if int64(len(entry.ChunkOffs)) != entry.NumChunks || int64(len(entry.Chunks)) != entry.NumChunks {
+			log.WithFields(log.Fields{
+				"Name":      entry.Name,
+				"Prefix":    entry.Prefix,
+				"NumChunks": entry.NumChunks,
+				"Version":   meta.Config.Version,
+			}).Error("Revelo: Entry without chunk offsets or hashes, regenerate the horcrux")
+			return syscall.EINVAL
+		}
+	}
+
+	return nil
+}
+
+// Checks the remote version ver local changes are on is signed by a
+// trusted key, and the local base meta is that version - the base meta and
+// working meta of an earlier mount are local files, so the remote meta is
+// what is verified. Local versions are not signed.
+func verifyBase(acc accio.Access, data *ReveloData, ver string, key []byte) error {
+	if verifyMode(data) == VERIFY_OFF {
+		return nil
+	}
+
+	if _, err := os.Stat(versionName(data.cacheDir, data.name, ver)); err == nil {
+		log.WithFields(log.Fields{"Version": ver}).Debug("Revelo: Local version, not verified")
+		return nil
+	}
+
+	remote, err := getRemoteFile(acc, remotePath(data.remoteDir, horcrux.VerMetaPath(ver, data.name)), key, data.cacheDir)
+	if err != nil {
+		// Made before version metas were kept - only the head has it
+		remote, err = getRemoteMeta(acc, data.remoteDir, data.name, key, data.cacheDir)
+		if err == nil && remote.CurrVer != ver {
+			err = syscall.ENOENT
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"Version": ver, "Error": err}).Warn("Revelo: Cannot get remote version to verify")
+		// Treated as unsigned
+		remote = &horcrux.Meta{CurrVer: ver}
+	}
+
+	if err := verifyMeta(data, remote); err != nil {
+		return err
+	}
+
+	base, err := readMeta(baseName(data), nil)
+	if err != nil || metaRoot(base) != metaRoot(remote) {
+		if verifyMode(data) == VERIFY_REQUIRE {
+			log.WithFields(log.Fields{"Version": ver}).Error("Revelo: Local base meta is not the remote version, not using it")
+			return ErrBaseChanged
+		}
+		log.WithFields(log.Fields{"Version": ver}).Warn("Revelo: Local base meta is not the remote version")
+	}
+
+	return nil
+}
+
+// Root hash of Meta - computed, if Meta has none
+func metaRoot(Meta *horcrux.Meta) string {
+	if Meta.Root != "" {
+		return Meta.Root
+	}
+	return horcrux.RootHash(Meta)
+}
+
+// Verify mode of data - warn if it has trusted keys and none was given
+func verifyMode(data *ReveloData) string {
+	if data.verify != "" {
+		return data.verify
+	}
+	if len(data.trusted) != 0 {
+		return VERIFY_WARN
+	}
+	return VERIFY_OFF
+}
+
+// Checks Meta got from remote is signed by a trusted key - fails if it is
+// not and data.verify is VERIFY_REQUIRE, else warns
+func verifyMeta(data *ReveloData, Meta *horcrux.Meta) error {
+	mode := verifyMode(data)
+	if mode == VERIFY_OFF {
+		return nil
+	}
+
+	err := codec.VerifyMeta(Meta, data.trusted)
+	if err == nil {
+		log.WithFields(log.Fields{"Version": Meta.CurrVer, "Key": Meta.Signature.Key}).Info("Revelo: Meta signature verified")
+		return nil
+	}
+
+	if mode == VERIFY_REQUIRE {
+		log.WithFields(log.Fields{"Version": Meta.CurrVer, "Error": err}).Error("Revelo: Meta not verified, not using it")
+		return err
+	}
+
+	log.WithFields(log.Fields{"Version": Meta.CurrVer, "Error": err}).Warn("Revelo: Meta not verified")
+	return nil
+}
+
 //
 // Handle Helper Functions
 //
 
+// Remote name of file name in horcrux top dir
+func remotePath(remoteDir string, name string) string {
+	if remoteDir == "" {
+		return name
+	}
+	return remoteDir + "/" + name
+}
+
+// Remote name of chunk with hash
+func remoteChunkName(data *ReveloData, hash string) string {
+	return remotePath(data.remoteDir, horcrux.ChunkPath(hash))
+}
+
+// Local name of a modified chunk of f
+func dirtyChunkName(f *FILE, chunkIdx int64) string {
+	return f.cacheName + "." + strconv.FormatInt(chunkIdx, 10)
+}
+
+// Gets clean chunk with hash to local cache, if its not there already
+// Returns the cache name
+func fetchChunk(h *HANDLE, hash string) (string, error) {
+	data := h.f.RData
+	cacheName := data.cacheDir + "/" + horcrux.ChunkPath(hash)
+
+	_, err := os.Stat(cacheName)
+	chunkPresent := ((err == nil) || !os.IsNotExist(err))
+	if chunkPresent {
+		return cacheName, nil
+	}
+
+	err = os.MkdirAll(path.Dir(cacheName), 0700) //XXX revisit permissions
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cacheName": cacheName,
+			"Perm":      0700,
+			"Error":     err,
+		}).Error("Revelo: Cannot Mkdirall")
+		return "", err
+	}
+
+	// Get to a tmp file first - chunk in cache by its hash is always complete
+	// and verified. Transfers can be truncated, objects can go bad in remote,
+	// so try a few times before giving up.
+	remoteName := remoteChunkName(data, hash)
+	acc := *h.Acc
+	for try := 1; try <= FETCH_RETRIES; try++ {
+		tmpFile, err := ioutil.TempFile(path.Dir(cacheName), path.Base(cacheName)+".")
+		if err != nil {
+			log.WithFields(log.Fields{"cacheName": cacheName, "Error": err}).Error("fetchChunk: Cannot create tmp file")
+			return "", err
+		}
+		tmpName := tmpFile.Name()
+		tmpFile.Close()
+
+		err = acc.GetFile(remoteName, tmpName)
+		if err == nil {
+			err = decodeChunk(data.codec, hash, tmpName)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"RemoteName": remoteName,
+				"CacheName":  cacheName,
+				"Try":        try,
+				"Error":      err,
+			}).Error("fetchChunk: Cannot get chunk")
+			os.Remove(tmpName)
+			continue
+		}
+
+		if err := os.Rename(tmpName, cacheName); err != nil {
+			log.WithFields(log.Fields{"cacheName": cacheName, "Error": err}).Error("fetchChunk: Cannot rename tmp file")
+			os.Remove(tmpName)
+			return "", err
+		}
+
+		return cacheName, nil
+	}
+
+	return "", fuse.EIO
+}
+
+// Decodes chunk with hash got from remote, in place, and verifies its hash
+func decodeChunk(c *codec.Codec, hash string, name string) error {
+	enc, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	if c.Passthrough() {
+		return verifyChunk(c, hash, enc)
+	}
+
+	dec, err := c.Decode(hash, enc)
+	if err != nil {
+		return err
+	}
+
+	if err := verifyChunk(c, hash, dec); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(name, dec, 0600)
+}
+
+// Checks chunk data against its hash
+func verifyChunk(c *codec.Codec, hash string, data []byte) error {
+	if got := c.Hash(data); got != hash {
+		log.WithFields(log.Fields{"Hash": hash, "Data Hash": got, "Size": len(data)}).Error("Revelo: Chunk hash mismatch")
+		return syscall.EIO
+	}
+	return nil
+}
+
+// Verifies clean chunks in local cache of horcrux Name
+//  - Bad chunks are removed, they are got again from remote when needed
+//  - Returns number of chunks checked and number of bad ones
+func Verify(Name string, key []byte, cacheDir string) (int, int, error) {
+	meta, err := readLocalMeta(cacheDir+"/"+Name+".meta", key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	c, err := codec.New(meta.Config, key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	checked, bad := 0, 0
+	err = filepath.Walk(cacheDir+"/"+horcrux.CHUNKDIR, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip dirs and tmp files of fetches in progress
+		hash := fi.Name()
+		if !fi.Mode().IsRegular() || strings.Contains(hash, ".") {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			log.WithFields(log.Fields{"Chunk": name, "Error": err}).Error("Verify: Cannot read chunk")
+			return err
+		}
+
+		checked++
+		if verifyChunk(c, hash, data) != nil {
+			log.WithFields(log.Fields{"Chunk": name}).Info("Verify: Removing bad chunk")
+			os.Remove(name)
+			bad++
+		}
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		// Nothing cached yet
+		err = nil
+	}
+
+	return checked, bad, err
+}
+
+// Moves clean chunk chunkIdx to dirty - chunk is going to be modified
+// If the whole chunk is going to be overwritten, don't bother getting it
+func dirtyChunk(h *HANDLE, chunkIdx int64, partial bool) error {
+	f := h.f
+	hash := f.Entry.Chunks[chunkIdx]
+	dirtyName := dirtyChunkName(f, chunkIdx)
+
+	log.WithFields(log.Fields{
+		"DirtyName": dirtyName,
+		"Hash":      hash,
+		"ChunkIdx":  chunkIdx,
+		"Partial":   partial,
+	}).Debug("Revelo::dirtyChunk")
+
+	err := os.MkdirAll(path.Dir(dirtyName), 0700) //XXX revisit permission
+	if err != nil {
+		log.WithFields(log.Fields{
+			"DirtyName": dirtyName,
+			"Perm":      0700,
+			"Error":     err,
+		}).Error("Revelo: Cannot MkdirAll")
+		return err
+	}
+
+	dirtyFile, err := os.OpenFile(dirtyName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600) //XXX Revisit perm
+	if err != nil {
+		log.WithFields(log.Fields{"DirtyName": dirtyName, "Error": err}).Error("dirtyChunk: Open failed")
+		return err
+	}
+	defer dirtyFile.Close()
+
+	if partial {
+		cacheName, err := fetchChunk(h, hash)
+		if err != nil {
+			log.Errorf("Revelo:dirtyChunk: Cannot get chunk %v for partial write, err %v", hash, err)
+			os.Remove(dirtyName)
+			return err
+		}
+
+		chFile, err := os.Open(cacheName)
+		if err != nil {
+			log.WithFields(log.Fields{"cacheName": cacheName, "Error": err}).Error("dirtyChunk: Open failed")
+			os.Remove(dirtyName)
+			return err
+		}
+		defer chFile.Close()
+
+		// Clean chunk can be longer if file was truncated
+		sz := chunkLen(f.RData.Config, &f.Entry, chunkIdx)
+		_, err = io.CopyN(dirtyFile, chFile, sz)
+		if err != nil && err != io.EOF {
+			log.WithFields(log.Fields{
+				"cacheName": cacheName,
+				"DirtyName": dirtyName,
+				"Error":     err,
+			}).Error("dirtyChunk: Copy failed")
+			os.Remove(dirtyName)
+			return err
+		}
+	}
+
+	newEntry := f.Entry
+	newEntry.Chunks = append([]string(nil), f.Entry.Chunks...)
+	newEntry.Chunks[chunkIdx] = ""
+	if err := updateMetaEntry(f.RData, f.Entry, newEntry); err != nil {
+		log.WithFields(log.Fields{"OldEntry": f.Entry,
+			"NewEntry": newEntry,
+		}).Error("dirtyChunk: updateMetaEntry Failed")
+		return err
+	}
+	f.Entry = newEntry
+
+	return saveMeta(f.RData)
+}
+
 // Creates a new chunk - extends file
 func createChunk(h *HANDLE, chunkIdx int64, buf []byte, off int, sz int) (int, error) {
 	var chFile *os.File
 	var err error
 	var wrote int
 
-	cacheName := h.f.cacheName + "." + strconv.FormatInt(chunkIdx, 10)
+	cacheName := dirtyChunkName(h.f, chunkIdx)
 	log.WithFields(log.Fields{
 		"CacheName": cacheName,
 		"ChunkIdx":  chunkIdx,
@@ -413,7 +1110,7 @@ func createChunk(h *HANDLE, chunkIdx int64, buf []byte, off int, sz int) (int, e
 	}
 	defer chFile.Close()
 
-	wrote, err = chFile.WriteAt(buf, int64(off))
+	wrote, err = chFile.WriteAt(buf[:sz], int64(off))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"ChunkName": cacheName,
@@ -434,20 +1131,30 @@ func writeChunk(h *HANDLE, chunkIdx int64, buf []byte, off int, sz int) (int, er
 	var err error
 	var wrote int
 
-	cacheName := h.f.cacheName + "." + strconv.FormatInt(chunkIdx, 10)
-	_, err = os.Stat(cacheName)
-	chunkPresent := ((err == nil) || !os.IsNotExist(err))
+	f := h.f
+	cacheName := dirtyChunkName(f, chunkIdx)
+	clean := f.Entry.Chunks[chunkIdx] != ""
 
 	log.WithFields(log.Fields{
 		"CacheName": cacheName,
 		"ChunkIdx":  chunkIdx,
 		"Offset":    off,
 		"Size":      sz,
-		"Present":   chunkPresent,
-		"Error":     err,
+		"Clean":     clean,
 	}).Debug("Write: writeChunk")
 
-	if chunkPresent == false {
+	if clean {
+		// Check if its partial write
+		partial := off > 0 || int64(sz) < chunkLen(f.RData.Config, &f.Entry, chunkIdx)
+		if err = dirtyChunk(h, chunkIdx, partial); err != nil {
+			log.WithFields(log.Fields{
+				"CacheName": cacheName,
+				"ChunkIdx":  chunkIdx,
+				"Error":     err,
+			}).Error("writeChunk: Cannot dirty chunk")
+			return 0, err
+		}
+	} else {
 		err = os.MkdirAll(path.Dir(cacheName), 0700) //XXX revisit permission
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -457,40 +1164,21 @@ func writeChunk(h *HANDLE, chunkIdx int64, buf []byte, off int, sz int) (int, er
 			}).Error("Revelo: Cannot MkdirAll")
 			return 0, err
 		}
-
-		// Check if its partial write
-		if sz < h.chunkSz {
-			// Get the chunk from remote
-			remoteName := h.f.remoteName + "." + strconv.FormatInt(chunkIdx, 10)
-			acc := *h.Acc
-			err = acc.GetFile(remoteName, cacheName)
-			if err != nil {
-				log.Errorf("Revelo:writeChunk: Cannot get chunk %v for partial write, err %v", remoteName, err)
-				return 0, err
-			}
-
-			chFile, err = os.OpenFile(cacheName, os.O_WRONLY, 0700) //XXX Revisit perm
-		} else {
-			//XXX Revisit perm
-			chFile, err = os.OpenFile(cacheName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-		}
-	} else {
-		chFile, err = os.OpenFile(cacheName, os.O_WRONLY, 0600) //XXX Revisit perm
 	}
 
+	chFile, err = os.OpenFile(cacheName, os.O_WRONLY|os.O_CREATE, 0600) //XXX Revisit perm
 	if err != nil {
 		log.WithFields(log.Fields{
-			"CacheName":    cacheName,
-			"Error":        err,
-			"ChunkPresent": chunkPresent,
-			"Size":         sz,
+			"CacheName": cacheName,
+			"Error":     err,
+			"Size":      sz,
 		}).Error("writeChunk: Open failed")
 		return 0, err
 	}
 	defer chFile.Close()
 
 	// Now we have the chunk or will be writing one
-	wrote, err = chFile.WriteAt(buf, int64(off))
+	wrote, err = chFile.WriteAt(buf[:sz], int64(off))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"ChunkName": cacheName,
@@ -507,23 +1195,28 @@ func writeChunk(h *HANDLE, chunkIdx int64, buf []byte, off int, sz int) (int, er
 
 // Write handler
 func (h *HANDLE) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	var chunkIdx, numChunks int64
-	var offInChunk int
+	var chunkIdx, offInChunk int64
 
 	f := h.f
+	if err := roCheck(f.RData); err != nil {
+		return err
+	}
+
+	f.RData.commitLock.RLock()
+	defer f.RData.commitLock.RUnlock()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	cfg := f.RData.Config
 	size := len(req.Data)
 	resp.Size = -1
 
-	chunkSz := h.chunkSz
-
-	// TODO: Use the masks!!
-	chunkIdx =  req.Offset / int64(chunkSz)
-	offInChunk = int(req.Offset - chunkIdx * int64(chunkSz))
+	chunkIdx, offInChunk = findChunk(cfg, &f.Entry, req.Offset)
 	newSize := req.Offset + int64(size)
 
 	log.WithFields(log.Fields{
 		"File":              f.cacheName,
-		"chunkSz":           chunkSz,
 		"chunkIdx":          chunkIdx,
 		"offInChunk":        offInChunk,
 		"numChunks in File": f.Entry.NumChunks,
@@ -532,24 +1225,19 @@ func (h *HANDLE) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.W
 
 	remain := size
 	wrote := 0
-	toWrite := chunkSz
 
 	for (remain > 0) && (chunkIdx < f.Entry.NumChunks) {
+		// Chunk boundaries don't move - write only till the next chunk
+		toWrite := int(chunkStart(cfg, &f.Entry, chunkIdx+1) - chunkStart(cfg, &f.Entry, chunkIdx) - offInChunk)
 		if remain < toWrite {
 			toWrite = remain
 		}
 
-		if offInChunk + toWrite > chunkSz {
-			// Spans more than one chunk
-			toWrite -= offInChunk
-		}
-
-		n, err := writeChunk(h, chunkIdx, req.Data[wrote:], offInChunk, toWrite)
+		n, err := writeChunk(h, chunkIdx, req.Data[wrote:], int(offInChunk), toWrite)
 		if err != nil || n == 0 {
 			log.WithFields(log.Fields{
 				"File":     f.cacheName,
 				"chunkIdx": chunkIdx,
-				"chunkSz":  chunkSz,
 				"OffSet":   offInChunk,
 				"Size":     toWrite,
 				"Wrote":    wrote,
@@ -560,13 +1248,17 @@ func (h *HANDLE) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.W
 		}
 
 		offInChunk = 0
-		toWrite = chunkSz
 
 		wrote += n
 		remain -= n
 		chunkIdx += 1
 	}
 
+	if err := touchFile(f); err != nil {
+		log.WithFields(log.Fields{"File": f.cacheName, "Error": err}).Error("Write: Cannot set times")
+		return err
+	}
+
 	if remain == 0 {
 		if newSize > f.Entry.Stat.Size {
 			// File size extended within chunk range
@@ -603,13 +1295,13 @@ func (h *HANDLE) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.W
 	}
 
 	// Extending file with new chunks
-	toWrite = chunkSz
 	for remain > 0 {
+		toWrite := int(maxChunkSize(cfg) - offInChunk)
 		if remain < toWrite {
 			toWrite = remain
 		}
 
-		n, err := createChunk(h, chunkIdx, req.Data[wrote:], offInChunk, toWrite)
+		n, err := createChunk(h, chunkIdx, req.Data[wrote:], int(offInChunk), toWrite)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"File":     f.cacheName,
@@ -628,18 +1320,24 @@ func (h *HANDLE) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.W
 	}
 
 	// update meta data
-	newSize = req.Offset + int64(size)
-	numChunks = (newSize + int64(chunkSz) - 1) / int64(chunkSz)
-	if numChunks > f.Entry.NumChunks {
+	if chunkIdx > f.Entry.NumChunks {
 		log.WithFields(log.Fields{
 			"OldSize":   f.Entry.Stat.Size,
 			"NewSize":   newSize,
 			"oldChunks": f.Entry.NumChunks,
-			"newChunks": numChunks,
+			"newChunks": chunkIdx,
 		}).Info("Write: Called to extend file")
 		newEntry := f.Entry
-		newEntry.NumChunks = numChunks
-		newEntry.Stat.Size = newSize
+		newEntry.ChunkOffs = f.Entry.ChunkOffs[:f.Entry.NumChunks:f.Entry.NumChunks]
+		newEntry.Chunks = f.Entry.Chunks[:f.Entry.NumChunks:f.Entry.NumChunks]
+		for i := f.Entry.NumChunks; i < chunkIdx; i++ {
+			newEntry.ChunkOffs = append(newEntry.ChunkOffs, chunkStart(cfg, &f.Entry, i))
+			newEntry.Chunks = append(newEntry.Chunks, "")
+		}
+		newEntry.NumChunks = chunkIdx
+		if newSize > newEntry.Stat.Size {
+			newEntry.Stat.Size = newSize
+		}
 		if err := updateMetaEntry(f.RData, f.Entry, newEntry); err != nil {
 			log.WithFields(log.Fields{"OldEntry": f.Entry,
 				"NewEntry": newEntry,
@@ -661,46 +1359,23 @@ func (h *HANDLE) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.W
 
 // Reads from chunk
 func readChunk(h *HANDLE, chunkIdx int64, buf []byte, off int, sz int) (int, error) {
-	remoteName := h.f.remoteName + "." + strconv.FormatInt(chunkIdx, 10)
-	cacheName := h.f.cacheName + "." + strconv.FormatInt(chunkIdx, 10)
+	var cacheName string
+	var err error
 
-	log.WithFields(log.Fields{
-		"CacheName":  cacheName,
-		"RemoteName": remoteName,
-		"ChunkIdx":   chunkIdx,
-		"Size":       sz,
-	}).Debug("readChunk")
+	hash := h.f.Entry.Chunks[chunkIdx]
 
-	_, err := os.Stat(cacheName)
-	chunkPresent := ((err == nil) || !os.IsNotExist(err))
 	log.WithFields(log.Fields{
-		"ChunkNAme":  cacheName,
-		"Present":    chunkPresent,
-		"Stat Error": err,
-	}).Debug("readChunk: Testing for presence")
-
-	if chunkPresent == false {
-		if remoteName == "" {
-			// Doesn't have a remote file, must be new local one
-			// We shouldn't be calling read first
-			log.WithFields(log.Fields{"cacheName": cacheName,
-				"chunkIdx": chunkIdx,
-				"Off":      off,
-				"Size":     sz,
-			}).Error("readChunk: cannot read - new local file without a remote... ")
-			return 0, syscall.ENOENT
-		}
+		"File":     h.f.cacheName,
+		"Hash":     hash,
+		"ChunkIdx": chunkIdx,
+		"Size":     sz,
+	}).Debug("readChunk")
 
-		err := os.MkdirAll(path.Dir(cacheName), 0700) //XXX revisit permissions
-		if err != nil {
-			log.WithFields(log.Fields{
-				"cacheName": cacheName,
-				"Perm":      0700,
-				"Error":     err,
-			}).Error("Revelo: Cannot Mkdirall")
-		}
-		acc := *h.Acc
-		err = acc.GetFile(remoteName, cacheName) //XXX Check for errors here
+	if hash == "" {
+		// Modified or new local chunk
+		cacheName = dirtyChunkName(h.f, chunkIdx)
+	} else {
+		cacheName, err = fetchChunk(h, hash)
 		if err != nil {
 			return 0, err
 		}
@@ -716,18 +1391,13 @@ func readChunk(h *HANDLE, chunkIdx int64, buf []byte, off int, sz int) (int, err
 	}
 	defer chFile.Close()
 
-	// Sz can be less or more than CHUNKSIZE  //XXX Clean this up?
-	if sz < h.chunkSz {
-		buf = buf[:sz]
-	} else {
-		buf = buf[:h.chunkSz]
-	}
+	// Caller limits sz to the chunk
+	buf = buf[:sz]
 
 	read, err := chFile.ReadAt(buf, int64(off))
 	if err != nil && err != io.EOF {
 		log.WithFields(log.Fields{
 			"ChunkName": cacheName,
-			"ChunkSize": h.chunkSz,
 			"Off":       off,
 			"Size":      sz,
 			"Read":      read,
@@ -741,36 +1411,41 @@ func readChunk(h *HANDLE, chunkIdx int64, buf []byte, off int, sz int) (int, err
 }
 
 func (h *HANDLE) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	var chunkIdx, numChunks int64
-	var offInChunk, totalRead int
+	var chunkIdx, offInChunk int64
+	var totalRead int
 
 	f := h.f
-	chunkSz := h.chunkSz
+	cfg := f.RData.Config
 
-	// TODO: Use the masks!!
-	chunkIdx = req.Offset / int64(chunkSz)
-	offInChunk = int(req.Offset - chunkIdx * int64(chunkSz))
-	numChunks = int64((req.Size + chunkSz - 1) / chunkSz)
+	f.lock.RLock()
+	defer f.lock.RUnlock()
 
-	if chunkIdx >= f.Entry.NumChunks || req.Size == 0 {
+	if req.Offset >= f.Entry.Stat.Size || req.Size == 0 {
 		resp.Data = []byte{}
 		return nil
 	}
 
-	if chunkIdx + numChunks > f.Entry.NumChunks {
-		numChunks = f.Entry.NumChunks - chunkIdx
+	chunkIdx, offInChunk = findChunk(cfg, &f.Entry, req.Offset)
+
+	size := int64(req.Size)
+	if req.Offset+size > f.Entry.Stat.Size {
+		size = f.Entry.Stat.Size - req.Offset
 	}
 
-	resp.Data = make([]byte, int(numChunks) * chunkSz)
-	remain := req.Size
+	resp.Data = make([]byte, size)
+	remain := int(size)
 	totalRead = 0
-	for i := int64(0); i < numChunks; i++ {
-		n, err := readChunk(h, chunkIdx+i, resp.Data[totalRead:], offInChunk, remain)
+	for ; remain > 0 && chunkIdx < f.Entry.NumChunks; chunkIdx++ {
+		toRead := int(chunkLen(cfg, &f.Entry, chunkIdx) - offInChunk)
+		if remain < toRead {
+			toRead = remain
+		}
+
+		n, err := readChunk(h, chunkIdx, resp.Data[totalRead:], int(offInChunk), toRead)
 		if err != nil && err != io.EOF {
 			log.WithFields(log.Fields{
 				"File":     f.cacheName,
 				"chunkIdx": chunkIdx,
-				"chunkSz": chunkSz,
 				"Error":    err,
 			}).Error("Read: readChunk failed")
 			return err
@@ -781,15 +1456,14 @@ func (h *HANDLE) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.Rea
 		remain -= n
 		totalRead += n
 
-		if err == io.EOF {
+		if n < toRead {
+			// Short chunk - don't read past it
 			break
 		}
-
 	}
 
 	resp.Data = resp.Data[:totalRead]
 	log.WithFields(log.Fields{
-		"Chunk Size": chunkSz,
 		"File":   f.cacheName,
 		"Offset": req.Offset,
 		"Size":   req.Size,
@@ -804,11 +1478,14 @@ func (h *HANDLE) Flush(ctx context.Context, req *fuse.FlushRequest) error {
 	// TODO: Flush all the modified chunks ???
 	// For that we need to keep track of modified chunks - part of ver control?
 
-	return nil
+	f := h.f
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return saveTimes(f)
 }
 
-// Release handler
-// TODO: Need this when we have &FILE same across multiple access
+// Release handler - HANDLE is kept with its FILE, for the next open
 func (h *HANDLE) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	return nil
 }
@@ -818,15 +1495,24 @@ func (h *HANDLE) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 ///////////////////////////
 
 func (f *FILE) Attr(ctx context.Context, a *fuse.Attr) error {
-	stat := f.Entry.Stat
-	a.Mode = stat.Mode
-	a.Size = uint64(stat.Size)
-	a.Uid = stat.Uid
-	a.Gid = stat.Gid
+	f.lock.RLock()
+	defer f.lock.RUnlock()
 
+	entryAttr(f.RData, &f.Entry, a)
 	return nil
 }
 
+// Symlinks are FILEs without chunks - the kernel only asks their target
+func (f *FILE) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if !f.Entry.IsLink() {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return f.Entry.Target, nil
+}
+
 func entrySetAttr(glbData *ReveloData, entry horcrux.Entry, req *fuse.SetattrRequest) (horcrux.Entry, error) {
 	var newEntry horcrux.Entry
 
@@ -844,12 +1530,6 @@ func entrySetAttr(glbData *ReveloData, entry horcrux.Entry, req *fuse.SetattrReq
 		log.Errorf("Setattr Lock owner for file %v, not supported", entry.Name)
 	}
 
-	// These, we might not support unless someone asks for it.
-	if valid.Atime() || valid.Mtime() || valid.AtimeNow() || valid.MtimeNow() {
-		//xxx returning error breaks some coreutils
-	     	log.Infof("Setattr {A,M}time* for file %v, not implemented yet", entry.Name)
-	}
-
 	if valid.Crtime() || valid.Chgtime() || valid.Bkuptime() || valid.Flags() {
 	     	log.Errorf("Setattr OSX attr for file %v, not supported", entry.Name)
 		return newEntry, syscall.ENOSYS
@@ -861,8 +1541,16 @@ func entrySetAttr(glbData *ReveloData, entry horcrux.Entry, req *fuse.SetattrReq
 		log.Errorf("Setattr Size for file %v, %v -> %v, sparse files not supported, disable it",
 			entry.Name, entry.Stat.Size, req.Size)
 		newEntry.Stat.Size = int64(req.Size)
-		if newEntry.Stat.Size < entry.Stat.Size {
-			newEntry.NumChunks = (newEntry.Stat.Size + int64(glbData.Config.ChunkSize) - 1)/int64(glbData.Config.ChunkSize)
+		if newEntry.Stat.Size < entry.Stat.Size && !entry.IsDir {
+			numChunks, offInChunk := findChunk(glbData.Config, &entry, newEntry.Stat.Size)
+			if offInChunk > 0 {
+				numChunks++
+			}
+			if numChunks < newEntry.NumChunks {
+				newEntry.NumChunks = numChunks
+				newEntry.ChunkOffs = entry.ChunkOffs[:numChunks:numChunks]
+				newEntry.Chunks = entry.Chunks[:numChunks:numChunks]
+			}
 		}
 	}
 
@@ -876,6 +1564,20 @@ func entrySetAttr(glbData *ReveloData, entry horcrux.Entry, req *fuse.SetattrReq
 		newEntry.Stat.Gid = req.Gid
 	}
 
+	// As touch - truncate sets mtime too, if not given
+	now := time.Now().UnixNano()
+	if valid.AtimeNow() {
+		newEntry.Stat.Atime = now
+	} else if valid.Atime() {
+		newEntry.Stat.Atime = req.Atime.UnixNano()
+	}
+	if valid.MtimeNow() || (valid.Size() && !valid.Mtime()) {
+		newEntry.Stat.Mtime = now
+	} else if valid.Mtime() {
+		newEntry.Stat.Mtime = req.Mtime.UnixNano()
+	}
+	newEntry.Stat.Ctime = now
+
 	if err := updateMetaEntry(glbData, entry, newEntry); err != nil {
 		log.WithFields(log.Fields{"OldEntry": entry,
 			"NewEntry": newEntry,
@@ -892,6 +1594,16 @@ func entrySetAttr(glbData *ReveloData, entry horcrux.Entry, req *fuse.SetattrReq
 }
 
 func (f *FILE) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if err := roCheck(f.RData); err != nil {
+		return err
+	}
+
+	f.RData.commitLock.RLock()
+	defer f.RData.commitLock.RUnlock()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
 	log.Debugf("Setattr: Path %v, file %v, valid %v", f.Entry.Prefix, f.Entry.Name, req.Valid)
 
 	entry, err := entrySetAttr(f.RData, f.Entry, req)
@@ -901,61 +1613,72 @@ func (f *FILE) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	}
 
 	// Size truncate, so adjust numChunks
+	// Clean chunks are shared, leave them alone - reads are limited by size
 	if entry.Stat.Size < f.Entry.Stat.Size {
-		lastChunkSize := entry.Stat.Size & int64(f.RData.Config.ChunkSize - 1)
-		if lastChunkSize > 0 {
-			os.Truncate(f.cacheName + "." + strconv.FormatInt(entry.NumChunks - 1, 10),
-					lastChunkSize)
+		last := entry.NumChunks - 1
+		if last >= 0 && entry.Chunks[last] == "" {
+			os.Truncate(dirtyChunkName(f, last), chunkLen(f.RData.Config, &entry, last))
 		}
-		for i:=entry.NumChunks; i<f.Entry.NumChunks; i++ {
-			os.Remove(f.cacheName + "." + strconv.FormatInt(i,10))
+		for i := entry.NumChunks; i < f.Entry.NumChunks; i++ {
+			if f.Entry.Chunks[i] == "" {
+				os.Remove(dirtyChunkName(f, i))
+			}
 		}
 	}
 
 	f.Entry = entry
-	resp.Attr.Mode = f.Entry.Stat.Mode
-	resp.Attr.Size = uint64(f.Entry.Stat.Size)
-	resp.Attr.Uid = f.Entry.Stat.Uid
-	resp.Attr.Gid = f.Entry.Stat.Gid
+	entryAttr(f.RData, &f.Entry, &resp.Attr)
 	return nil
 }
 
+// Open handler - all opens of a file share its HANDLE
 func (f *FILE) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		if err := roCheck(f.RData); err != nil {
+			return nil, err
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
 
 	log.WithFields(log.Fields{
-		"File":        f.Entry.Name,
-		"Cache Name":  f.cacheName,
-		"Remote Name": f.remoteName,
+		"File":       f.Entry.Name,
+		"Cache Name": f.cacheName,
 	}).Debug("Revelo: Open")
 
-	// XXX TODO XXX XXX XXX
-	// Fix this - need to preserve f, h across lookups, open
-	// to handle the o_excl, etc.
+	// Entry could have changed since lookup (ex: reset)
+	f.RData.lock.RLock()
+	node, err := dirTree.Lookup(f.RData.Root, f.Entry.Prefix, f.Entry.Name)
+	if err == nil {
+		f.Entry = node.Entry
+	}
+	f.RData.lock.RUnlock()
 
-	if f.h != nil {
-		//XXX Cannot happen now!!
-		log.WithFields(log.Fields{
-			"File":   f.Entry.Name,
-			"Handle": f.h,
-		}).Warning("Revelo: Open - Handle not null, more than one openers")
-		return f.h, nil
+	if err != nil {
+		log.WithFields(log.Fields{"File": f.Entry.Name, "Error": err}).Error("Revelo: Open - not in dirTree")
+		return nil, fuse.ENOENT
 	}
 
-	h := &HANDLE{Acc: f.Acc, f:f, chunkSz: f.RData.Config.ChunkSize}
-	f.h = h
+	if f.h == nil {
+		f.h = &HANDLE{Acc: f.Acc, f: f}
+	}
 
 	log.WithFields(log.Fields{
 		"File":   f.Entry.Name,
 		"Flags":  req.Flags,
 		"Handle": f.h,
 	}).Debug("Open: ")
-	return h, nil
+	return f.h, nil
 }
 
 // Fsync handler
 // XXX Sync the chunk files here??
 func (f *FILE) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
-	return nil
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return saveTimes(f)
 }
 
 //////////////////
@@ -963,36 +1686,52 @@ func (f *FILE) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 /////////////////
 
 func (f FS) Root() (fs.Node, error) {
-	var remoteDir string
-
 	root := f.RData.Root.Entry
-	if f.remoteDir == "" {
-		remoteDir = f.RData.CurrVer + "/" + root.Name
-	} else {
-		remoteDir = f.remoteDir + "/" + f.RData.CurrVer + "/" + root.Name
-	}
 
-	return &DIR{
-		Acc:       f.Acc,
-		RData:     f.RData,
-		Entry:     root,
-		remoteDir: remoteDir,
-		cacheDir:  f.cacheDir,
-	}, nil
+	d := &DIR{
+		Acc:      f.Acc,
+		RData:    f.RData,
+		Entry:    root,
+		cacheDir: f.cacheDir + "/" + CACHE_DIRTYDIR,
+	}
+	putNode(f.RData, root.Ino, d)
+	return d, nil
 }
 
 func (d *DIR) Attr(ctx context.Context, attr *fuse.Attr) error {
-	stat := d.Entry.Stat
-	attr.Mode = stat.Mode
-	attr.Size = uint64(stat.Size)
-	attr.Uid = stat.Uid
-	attr.Gid = stat.Gid
+	entry, _ := d.get()
+
+	// Times change with its kids, in the tree
+	d.RData.lock.RLock()
+	if n, err := dirTree.Lookup(d.RData.Root, entry.Prefix, entry.Name); err == nil {
+		entry = n.Entry
+	}
+	d.RData.lock.RUnlock()
+
+	entryAttr(d.RData, &entry, attr)
 	return nil
 }
 
 func (d *DIR) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if err := roCheck(d.RData); err != nil {
+		return err
+	}
+
+	d.RData.commitLock.RLock()
+	defer d.RData.commitLock.RUnlock()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
 	log.Debugf("Setattr: Path %v, file %v, valid %v", d.Entry.Prefix, d.Entry.Name, req.Valid)
 
+	// Times in the tree are newer, see touchDir
+	d.RData.lock.RLock()
+	if n, err := dirTree.Lookup(d.RData.Root, d.Entry.Prefix, d.Entry.Name); err == nil {
+		d.Entry = n.Entry
+	}
+	d.RData.lock.RUnlock()
+
 	entry, err := entrySetAttr(d.RData, d.Entry, req)
 	if err != nil {
 		log.Errorf("Setattr: error %v", err)
@@ -1000,50 +1739,41 @@ func (d *DIR) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 	}
 
 	d.Entry = entry
-
-	resp.Attr.Mode = d.Entry.Stat.Mode
-	resp.Attr.Size = uint64(d.Entry.Stat.Size)
-	resp.Attr.Uid = d.Entry.Stat.Uid
-	resp.Attr.Gid = d.Entry.Stat.Gid
+	entryAttr(d.RData, &d.Entry, &resp.Attr)
 	return nil
 }
 
 func (d *DIR) strLookup(ctx context.Context, Name string) (fs.Node, error) {
+	dirEntry, _ := d.get()
 
 	var dirPrefix string
-	if d.Entry.Prefix != "" {
-		dirPrefix = d.Entry.Prefix + "/" + d.Entry.Name
+	if dirEntry.Prefix != "" {
+		dirPrefix = dirEntry.Prefix + "/" + dirEntry.Name
 	} else {
-		dirPrefix = d.Entry.Name
+		dirPrefix = dirEntry.Name
 	}
 
-	d.RData.lock.RLock()
-	defer d.RData.lock.RUnlock()
+	if isSnapDir(d, Name) {
+		return &SNAPDIR{Acc: d.Acc, RData: d.RData}, nil
+	}
 
 	log.WithFields(log.Fields{"Entry": Name, "Dir Prefix": dirPrefix}).Debug("dirTree Lookup: ")
 
+	d.RData.lock.RLock()
 	dirTreeNode, err := dirTree.Lookup(d.RData.Root, dirPrefix, Name)
+	var entry horcrux.Entry
+	if err == nil {
+		entry = linkFile(d.RData, dirTreeNode.Entry)
+	}
+	d.RData.lock.RUnlock()
+
 	if err != nil {
 		log.WithFields(log.Fields{"Name": Name, "Error": err}).Error("Lookup: dirTree lookup failed")
 		return nil, fuse.ENOENT
 	}
 
-	entry := dirTreeNode.Entry
-
-	if entry.IsDir {
-		return &DIR{Acc: d.Acc,
-			RData:     d.RData,
-			Entry:     entry,
-			remoteDir: d.remoteDir + "/" + Name,
-			cacheDir:  d.cacheDir + "/" + Name}, nil
-	}
-
-	return &FILE{Acc: d.Acc,
-		RData:      d.RData,
-		Entry:      entry,
-		remoteName: d.remoteDir + "/" + Name,
-		cacheName:  d.cacheDir + "/" + Name,
-		h:          nil}, nil
+	// Node locks are taken before the tree lock
+	return getNode(d, entry), nil
 }
 
 func (d *DIR) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
@@ -1057,31 +1787,33 @@ func (d *DIR) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 }
 
 func (d *DIR) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dirEntry, _ := d.get()
 
 	dirDirs := []fuse.Dirent{}
 
-	log.WithFields(log.Fields{"Dir": d.Entry.Name, "Prefix": d.Entry.Prefix}).Debug("ReadDirAll: ")
+	log.WithFields(log.Fields{"Dir": dirEntry.Name, "Prefix": dirEntry.Prefix}).Debug("ReadDirAll: ")
 
 	d.RData.lock.RLock()
-	dirTreeNode, err := dirTree.Lookup(d.RData.Root, d.Entry.Prefix, d.Entry.Name)
-	tmp := *dirTreeNode
-	d.RData.lock.RUnlock()
+	defer d.RData.lock.RUnlock()
 
+	dirTreeNode, err := dirTree.Lookup(d.RData.Root, dirEntry.Prefix, dirEntry.Name)
 	if err != nil {
-		log.WithFields(log.Fields{"Name": d.Entry.Name, "Error": err}).Error("ReadDirAll: dirTree lookup failed")
+		log.WithFields(log.Fields{"Name": dirEntry.Name, "Error": err}).Error("ReadDirAll: dirTree lookup failed")
 		return nil, fuse.ENOENT
 	}
 
-	for i := 0; i < dirTree.NumKids(&tmp); i++ {
-		k, _ := dirTree.GetKid(&tmp, i)
+	for i := 0; i < dirTree.NumKids(dirTreeNode); i++ {
+		k, _ := dirTree.GetKid(dirTreeNode, i)
 		ent := k.Entry
 		t := fuse.DT_Unknown
 		if ent.IsDir {
 			t = fuse.DT_Dir
+		} else if ent.IsLink() {
+			t = fuse.DT_Link
 		} else {
 			t = fuse.DT_File
 		}
-		dirDirs = append(dirDirs, fuse.Dirent{Inode: 0, Type: t, Name: ent.Name})
+		dirDirs = append(dirDirs, fuse.Dirent{Inode: nodeInode(d.RData, &ent), Type: t, Name: ent.Name})
 	}
 
 	return dirDirs, nil
@@ -1099,7 +1831,14 @@ func (d *DIR) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 	// log.Debug("Revelo:: Create called")
 
 	acc := d.Acc
-	entry := d.Entry
+	entry, cacheDir := d.get()
+
+	if err := roCheck(d.RData); err != nil {
+		return nil, nil, err
+	}
+
+	d.RData.commitLock.RLock()
+	defer d.RData.commitLock.RUnlock()
 
 	var prefix string
 	if entry.Prefix == "" {
@@ -1108,11 +1847,17 @@ func (d *DIR) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 		prefix = entry.Prefix + "/" + entry.Name
 	}
 
-	stat := horcrux.Stat{Mode: req.Mode, Size: 0, Uid: entry.Stat.Uid, Gid: entry.Stat.Gid}
+	now := time.Now().UnixNano()
+	stat := horcrux.Stat{Mode: req.Mode, Size: 0, Uid: entry.Stat.Uid, Gid: entry.Stat.Gid,
+		Atime: now, Mtime: now, Ctime: now}
 	newEntry := horcrux.Entry{Name: req.Name, Prefix: prefix, IsDir: false, Stat: stat, NumChunks: 0}
 
 	d.RData.lock.Lock()
+	newEntry.Ino = newInode(d.RData)
 	err := dirTree.Insert(d.RData.Root, newEntry)
+	if err == nil {
+		touchDir(d.RData, prefix, now)
+	}
 	d.RData.lock.Unlock()
 
 	if err != nil {
@@ -1126,18 +1871,15 @@ func (d *DIR) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 	}
 
 	f := &FILE{Acc: acc,
-		RData:      d.RData,
-		Entry:      newEntry,
-		cacheName:  d.cacheDir + "/" + req.Name,
-		remoteName: ""}
+		RData:     d.RData,
+		Entry:     newEntry,
+		cacheName: cacheDir + "/" + req.Name}
 
-	h := &HANDLE{Acc: acc, f: f, chunkSz: f.RData.Config.ChunkSize}
+	h := &HANDLE{Acc: acc, f: f}
 	f.h = h
+	putNode(d.RData, newEntry.Ino, f)
 
-	resp.LookupResponse.Attr = fuse.Attr{Mode: stat.Mode,
-		Size: uint64(stat.Size),
-		Uid:  stat.Uid,
-		Gid:  stat.Gid}
+	entryAttr(d.RData, &newEntry, &resp.LookupResponse.Attr)
 
 	// XXX Populate resp.OpenResponse.Flags properly
 	// resp.OpenResponse.Flags = ???
@@ -1146,14 +1888,132 @@ func (d *DIR) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 	return f, h, nil
 }
 
+func (d *DIR) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if err := roCheck(d.RData); err != nil {
+		return nil, err
+	}
+
+	d.RData.commitLock.RLock()
+	defer d.RData.commitLock.RUnlock()
+
+	entry, cacheDir := d.get()
+
+	var prefix string
+	if entry.Prefix == "" {
+		prefix = entry.Name
+	} else {
+		prefix = entry.Prefix + "/" + entry.Name
+	}
+
+	// Size of a symlink is the length of its target, as in lstat
+	now := time.Now().UnixNano()
+	stat := horcrux.Stat{Mode: os.ModeSymlink | 0777, Size: int64(len(req.Target)), Uid: entry.Stat.Uid, Gid: entry.Stat.Gid,
+		Atime: now, Mtime: now, Ctime: now}
+	newEntry := horcrux.Entry{Name: req.NewName, Prefix: prefix, IsDir: false, Stat: stat, NumChunks: 0, Target: req.Target}
+
+	d.RData.lock.Lock()
+	newEntry.Ino = newInode(d.RData)
+	err := dirTree.Insert(d.RData.Root, newEntry)
+	if err == nil {
+		touchDir(d.RData, prefix, now)
+	}
+	d.RData.lock.Unlock()
+
+	if err != nil {
+		log.WithFields(log.Fields{"newEntry": newEntry, "Error": err}).Error("Symlink: Cannot insert new entry")
+		return nil, err
+	}
+
+	if err := saveMeta(d.RData); err != nil {
+		log.Error("Symlink: save Meta failed")
+		return nil, err
+	}
+
+	f := &FILE{Acc: d.Acc,
+		RData:     d.RData,
+		Entry:     newEntry,
+		cacheName: cacheDir + "/" + req.NewName}
+	putNode(d.RData, newEntry.Ino, f)
+
+	return f, nil
+}
+
+// Hard link to old - a FILE, that shares its node and data with the link
+func (d *DIR) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	f, ok := old.(*FILE)
+	if !ok {
+		return nil, fuse.Errno(syscall.EPERM)
+	}
+
+	if f.RData != d.RData {
+		return nil, fuse.Errno(syscall.EXDEV)
+	}
+
+	if err := roCheck(d.RData); err != nil {
+		return nil, err
+	}
+
+	d.RData.commitLock.RLock()
+	defer d.RData.commitLock.RUnlock()
+
+	entry, _ := d.get()
+
+	var prefix string
+	if entry.Prefix == "" {
+		prefix = entry.Name
+	} else {
+		prefix = entry.Prefix + "/" + entry.Name
+	}
+
+	f.lock.RLock()
+	file := f.Entry
+	f.lock.RUnlock()
+
+	d.RData.lock.Lock()
+	err := addLink(d.RData, file, prefix, req.NewName)
+	if err == nil {
+		touchDir(d.RData, prefix, time.Now().UnixNano())
+	}
+	d.RData.lock.Unlock()
+
+	if err != nil {
+		log.WithFields(log.Fields{"File": file.Name, "Prefix": prefix, "Name": req.NewName, "Error": err}).Error("Link: Cannot add link")
+		return nil, err
+	}
+
+	if err := saveMeta(d.RData); err != nil {
+		log.Error("Link: save Meta failed")
+		return nil, err
+	}
+
+	return f, nil
+}
+
 func (d *DIR) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if err := roCheck(d.RData); err != nil {
+		return err
+	}
+
+	d.RData.commitLock.RLock()
+	defer d.RData.commitLock.RUnlock()
+
+	dirEntry, cacheDir := d.get()
+
 	dirPrefix := ""
-	if d.Entry.Prefix != "" {
-		dirPrefix = d.Entry.Prefix + "/" + d.Entry.Name
+	if dirEntry.Prefix != "" {
+		dirPrefix = dirEntry.Prefix + "/" + dirEntry.Name
 	}
 
 	d.RData.lock.Lock()
 	remEntry, err := dirTree.Delete(d.RData.Root, dirPrefix, req.Name, req.Dir)
+	var moved horcrux.Entry
+	var hasMoved bool
+	if err == nil && !req.Dir {
+		moved, hasMoved = unlink(d.RData, remEntry)
+	}
+	if err == nil {
+		touchDir(d.RData, dirPrefix, time.Now().UnixNano())
+	}
 	d.RData.lock.Unlock()
 
 	if err != nil {
@@ -1167,16 +2027,24 @@ func (d *DIR) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	}
 
 	//Remove temp cache dir/files...
-	cacheName := d.cacheDir + "/" + req.Name
+	cacheName := cacheDir + "/" + req.Name
 	if req.Dir {
 		log.Debugf("Remove: Removing cache dir %v", cacheName)
 		os.Remove(cacheName)
 		return nil
 	}
 
-	log.Debugf("Remove: Removing cacheFiles %v.[0-%d]", cacheName, remEntry.NumChunks - 1)
-	for i:=int64(0); i<remEntry.NumChunks; i++ {
-		os.Remove(cacheName + "." + strconv.FormatInt(i, 10))
+	// Other names of the file have its data now
+	if hasMoved {
+		return moveFile(d.RData, cacheName, moved)
+	}
+
+	// Only the dirty chunks - clean ones may be shared with other files
+	log.Debugf("Remove: Removing dirty cacheFiles %v.[0-%d]", cacheName, remEntry.NumChunks - 1)
+	for i, hash := range remEntry.Chunks {
+		if hash == "" {
+			os.Remove(cacheName + "." + strconv.Itoa(i))
+		}
 	}
 	return nil
 }
@@ -1184,7 +2052,14 @@ func (d *DIR) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 func (d *DIR) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
 	var prefix string
 
-	entry := d.Entry
+	if err := roCheck(d.RData); err != nil {
+		return nil, err
+	}
+
+	d.RData.commitLock.RLock()
+	defer d.RData.commitLock.RUnlock()
+
+	entry, cacheDir := d.get()
 	if entry.Prefix == "" {
 		prefix = entry.Name
 	} else {
@@ -1193,7 +2068,9 @@ func (d *DIR) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 
 	//XXX Revisit size value - 4k for now.
 	//XXX Should we use local Uid, Gid?
-	stat := horcrux.Stat{Mode: req.Mode, Size: 4096, Uid: entry.Stat.Uid, Gid: entry.Stat.Gid}
+	now := time.Now().UnixNano()
+	stat := horcrux.Stat{Mode: req.Mode, Size: 4096, Uid: entry.Stat.Uid, Gid: entry.Stat.Gid,
+		Atime: now, Mtime: now, Ctime: now}
 	newEntry := horcrux.Entry{
 		Name:      req.Name,
 		Prefix:    prefix,
@@ -1202,7 +2079,11 @@ func (d *DIR) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 		NumChunks: 0}
 
 	d.RData.lock.Lock()
+	newEntry.Ino = newInode(d.RData)
 	err := dirTree.Insert(d.RData.Root, newEntry)
+	if err == nil {
+		touchDir(d.RData, prefix, now)
+	}
 	d.RData.lock.Unlock()
 
 	if err != nil {
@@ -1220,108 +2101,159 @@ func (d *DIR) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 	}
 
 	newD := &DIR{Acc: d.Acc,
-		RData:     d.RData,
-		Entry:     newEntry,
-		cacheDir:  d.cacheDir + "/" + req.Name,
-		remoteDir: ""}
+		RData:    d.RData,
+		Entry:    newEntry,
+		cacheDir: cacheDir + "/" + req.Name}
+	putNode(d.RData, newEntry.Ino, newD)
 
 	return newD, nil
 }
 
-//
-// XXX Should we handle Rename ???
-// If yes, how do we treat the files - as new or just the old ones?
-// Just the old ones is not good. Cannot get from remote as names changed and
-// we are not keeping track of remote names separately. We might, if we need this functionality
-//
-/* COMMENTED OUT FOR NOW!!
+// Rename handler - a move in dirTree, remote chunks are by hash so they
+// are not moved. Dirty chunks are by path, they are moved along.
 func (d *DIR) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
-	var oldPrefix, newPrefix string
-
 	nd, ok := newDir.(*DIR)
 	if !ok {
 		log.WithFields(log.Fields{"newDir": newDir}).Error("Rename: New Dir is not a DIR")
-		return syscall.EINVAL	// Should we fix fuse.error ???
+		return fuse.Errno(syscall.EXDEV)
 	}
 
-	if d.Entry.Prefix != "" {
-		oldPrefix = d.Entry.Prefix + "/" + d.Entry.Name
-	} else {
-		oldPrefix = d.Entry.Name
+	if err := roCheck(d.RData); err != nil {
+		return err
 	}
 
-	if nd.Entry.Prefix != "" {
-		newPrefix = nd.Entry.Prefix + "/" + nd.Entry.Name
-	} else {
-		newPrefix = nd.Entry.Name
+	if nd.RData != d.RData {
+		// Into or out of a snapshot
+		return fuse.Errno(syscall.EXDEV)
 	}
 
-	log.WithFields(log.Fields{"Dir": d, "newDir": nd, "Request": req,
-			  "Old Prefix": oldPrefix, "New Prefix": newPrefix,
-		}).Error("Rename request")
+	d.RData.commitLock.RLock()
+	defer d.RData.commitLock.RUnlock()
 
-	//XXX
-	//XXX Do the locking properly, when we do support rename
+	oldEntry, oldDir := d.get()
+	newEntry, newCacheDir := nd.get()
 
-	d.RData.lock.Lock()
+	oldPrefix := oldEntry.Name
+	if oldEntry.Prefix != "" {
+		oldPrefix = oldEntry.Prefix + "/" + oldEntry.Name
+	}
 
-	foundDir := false
-	idx := -1
-	for i, ent := range d.RData.Meta.Entries {
-		if ent.Prefix == oldPrefix && ent.Name == req.OldName {
-			if ent.IsDir == false {
-				d.RData.Meta.Entries[i].Prefix = newPrefix
-				d.RData.Meta.Entries[i].Name = req.NewName
-				d.Entry = d.RData.Meta.Entries[i]
-
-				d.RData.lock.Unlock()
-
-				//XXX We are not verifying the New Dir to be part of Meta.Entries now..
-				//XXX Is it even possible? I guess not as it will be lookuped up before
-				//XXX this is called...
-				if err := saveMeta(d.Acc, d.RData); err != nil {
-					log.Error("Rename file: cannot save Meta")
-					return err
-				}
-
-				return nil
-			} else {
-				foundDir = true
-				idx = i
-				break
-			}
-		}
+	newPrefix := newEntry.Name
+	if newEntry.Prefix != "" {
+		newPrefix = newEntry.Prefix + "/" + newEntry.Name
 	}
 
-	if !foundDir {
+	log.WithFields(log.Fields{
+		"Old Prefix": oldPrefix,
+		"Old Name":   req.OldName,
+		"New Prefix": newPrefix,
+		"New Name":   req.NewName,
+	}).Debug("Rename")
+
+	d.RData.lock.Lock()
+	if sameFile(d.RData, oldPrefix, req.OldName, newPrefix, req.NewName) {
+		// Two names of the same file - nothing to do
 		d.RData.lock.Unlock()
-		return syscall.ENOENT
+		return nil
+	}
+	replaced, err := dirTree.Rename(d.RData.Root, oldPrefix, req.OldName, newPrefix, req.NewName)
+	var entry, moved horcrux.Entry
+	var hasMoved bool
+	if err == nil {
+		node, _ := dirTree.Lookup(d.RData.Root, newPrefix, req.NewName)
+		entry = node.Entry
+		if replaced != nil && !replaced.IsDir {
+			moved, hasMoved = unlink(d.RData, replaced)
+		}
+
+		now := time.Now().UnixNano()
+		touchDir(d.RData, oldPrefix, now)
+		touchDir(d.RData, newPrefix, now)
+	}
+	d.RData.lock.Unlock()
+
+	if err != nil {
+		log.WithFields(log.Fields{"Prefix": oldPrefix, "Name": req.OldName, "Error": err}).Error("Rename: Cannot move in dir tree")
+		return err
+	}
+
+	if err := saveMeta(d.RData); err != nil {
+		log.Error("Rename: cannot update meta")
+		return err
+	}
+
+	oldName := oldDir + "/" + req.OldName
+	newName := newCacheDir + "/" + req.NewName
+	if oldName == newName {
+		return nil
 	}
 
-	// Rename a dir
-	d.RData.Meta.Entries[idx].Prefix = newPrefix
-	d.RData.Meta.Entries[idx].Name = req.NewName
-	d.Entry = d.RData.Meta.Entries[idx]
+	// Nothing is at newName in the tree now - left overs go, or move to
+	// another name of the replaced file
+	if hasMoved {
+		moveFile(d.RData, newName, moved)
+	} else if replaced != nil {
+		removeDirtyChunks(newName, replaced)
+	} else if entry.IsDir {
+		os.RemoveAll(newName)
+	}
+
+	err = moveDirtyChunks(oldName, newName, &entry)
+
+	// Nodes the kernel has keep their inode, with the new path
+	moveNodes(d.RData, newPrefix, req.NewName, newName)
+	return err
+}
 
-	oldPrefix = oldPrefix + "/" + req.OldName
-	newPrefix = newPrefix + "/" + req.NewName
+// Removes dirty chunks of entry, at cacheName
+func removeDirtyChunks(cacheName string, entry *horcrux.Entry) {
+	if entry.IsDir {
+		os.RemoveAll(cacheName)
+		return
+	}
 
-	for i, e2 := range d.RData.Meta.Entries {
-		if e2.Prefix == oldPrefix {
-			d.RData.Meta.Entries[i].Prefix = newPrefix
+	// Only the dirty chunks - clean ones may be shared with other files
+	for i, hash := range entry.Chunks {
+		if hash == "" {
+			os.Remove(cacheName + "." + strconv.Itoa(i))
 		}
 	}
+}
 
-	d.RData.lock.Unlock()
+// Moves dirty chunks of entry from oldName to newName - all below it, for a dir
+func moveDirtyChunks(oldName string, newName string, entry *horcrux.Entry) error {
+	move := func(from string, to string) error {
+		if _, err := os.Lstat(from); os.IsNotExist(err) {
+			return nil
+		}
 
-	if err := saveMeta(d.Acc, d.RData); err != nil {
-		log.Error("Rename dir: cannot save Meta")
-		return err
+		if err := os.MkdirAll(path.Dir(to), 0700); err != nil {
+			return err
+		}
+
+		if err := os.Rename(from, to); err != nil {
+			log.WithFields(log.Fields{"From": from, "To": to, "Error": err}).Error("Rename: Cannot move dirty chunks")
+			return err
+		}
+		return nil
 	}
 
+	if entry.IsDir {
+		return move(oldName, newName)
+	}
+
+	for i, hash := range entry.Chunks {
+		if hash != "" {
+			continue
+		}
+
+		idx := "." + strconv.Itoa(i)
+		if err := move(oldName+idx, newName+idx); err != nil {
+			return err
+		}
+	}
 	return nil
 }
-*/
 
 // XXX This is duplicate code...
 // TODO: Give credit to bazil.org/fuse or whoever wrote this originally
@@ -0,0 +1,249 @@
+//
+// Snapshots - versions of the horcrux, read only, inside the mount:
+// <mnt>/SNAP_DIR/SNAP_VERDIR/<ver>/...
+//  - Served by the same DIR/FILE as the mount, with a ReveloData of the
+//    version (snapshot) - chunks are got on demand, into the same chunk
+//    cache as the mount
+//  - Versions listed are from the history of the mounted version, without
+//    pruned ones. Any other version (ex: newer ones pushed since) can be
+//    looked up by name
+//  - Local versions (see commit.go) are there too, remote ones are verified
+//    as on mount (see verifyMeta)
+//  - A version is read when first looked up, and kept till unmount
+//  - SNAP_DIR is not listed in the mount root - cp -r, du or find of the
+//    mount dont walk all versions. It hides a SNAP_DIR in the data, if any.
+//
+
+package revelo
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/muthu-r/horcrux/bazil-fuse/fuse"
+	"github.com/muthu-r/horcrux/bazil-fuse/fuse/fs"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/accio"
+	"github.com/muthu-r/horcrux/codec"
+	"github.com/muthu-r/horcrux/revelo/dirTree"
+)
+
+const (
+	SNAP_DIR    = ".horcrux"
+	SNAP_VERDIR = "versions"
+)
+
+// SNAP_DIR in the mount root
+type SNAPDIR struct {
+	Acc   *accio.Access
+	RData *ReveloData
+}
+
+// SNAP_VERDIR, has a dir for each version
+type VERSDIR struct {
+	Acc   *accio.Access
+	RData *ReveloData
+}
+
+// Is Name in d SNAP_DIR - only in the root of a mount, not of a snapshot
+func isSnapDir(d *DIR, Name string) bool {
+	entry, _ := d.get()
+	return Name == SNAP_DIR && entry.Prefix == "" && !d.RData.snapshot
+}
+
+func snapAttr(data *ReveloData, attr *fuse.Attr) {
+	data.lock.RLock()
+	stat := data.Root.Entry.Stat
+	data.lock.RUnlock()
+
+	attr.Mode = os.ModeDir | 0555
+	attr.Uid = stat.Uid
+	attr.Gid = stat.Gid
+}
+
+func (s *SNAPDIR) Attr(ctx context.Context, attr *fuse.Attr) error {
+	snapAttr(s.RData, attr)
+	return nil
+}
+
+func (s *SNAPDIR) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	if req.Name != SNAP_VERDIR {
+		return nil, fuse.ENOENT
+	}
+
+	v := &VERSDIR{Acc: s.Acc, RData: s.RData}
+	return v, v.Attr(ctx, &resp.Attr)
+}
+
+func (s *SNAPDIR) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{{Type: fuse.DT_Dir, Name: SNAP_VERDIR}}, nil
+}
+
+func (v *VERSDIR) Attr(ctx context.Context, attr *fuse.Attr) error {
+	snapAttr(v.RData, attr)
+	return nil
+}
+
+func (v *VERSDIR) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	snap, err := getSnapshot(*v.Acc, v.RData, req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	snap.lock.RLock()
+	root := snap.Root.Entry
+	snap.lock.RUnlock()
+
+	d := &DIR{
+		Acc:      v.Acc,
+		RData:    snap,
+		Entry:    root,
+		cacheDir: snap.workDir + "/" + CACHE_DIRTYDIR,
+	}
+	return d, d.Attr(ctx, &resp.Attr)
+}
+
+func (v *VERSDIR) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	data := v.RData
+
+	data.lock.RLock()
+	history, currVer := data.History, data.CurrVer
+	data.lock.RUnlock()
+
+	remoteVers := snapVersions(*v.Acc, data, len(history))
+	has := func(ver string) bool {
+		if remoteVers == nil || remoteVers[ver] {
+			return true
+		}
+		_, err := os.Stat(versionName(data.cacheDir, data.name, ver))
+		return err == nil
+	}
+
+	var dirs []fuse.Dirent
+	seen := make(map[string]bool)
+	for _, rec := range liveHistory(history, currVer, has) {
+		dirs = append(dirs, fuse.Dirent{Type: fuse.DT_Dir, Name: rec.Name})
+		seen[rec.Name] = true
+	}
+
+	// Made before history was kept
+	if !seen[currVer] {
+		dirs = append(dirs, fuse.Dirent{Type: fuse.DT_Dir, Name: currVer})
+	}
+
+	return dirs, nil
+}
+
+// Remote versions of mount data with histLen history records - listed
+// again only when the history grows (pull, commit), as it lists the whole
+// remote. nil if they cannot be listed - all are shown then.
+func snapVersions(acc accio.Access, data *ReveloData, histLen int) map[string]bool {
+	data.snapLock.Lock()
+	defer data.snapLock.Unlock()
+
+	if data.remoteVers != nil && data.remoteVersLen == histLen {
+		return data.remoteVers
+	}
+
+	vers, err := remoteVersions(acc, data.remoteDir, data.name)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Warn("Snapshot: Cannot list remote versions")
+		return nil
+	}
+
+	data.remoteVers = vers
+	data.remoteVersLen = histLen
+	return vers
+}
+
+// Snapshot of version ver of mount data - read the first time
+func getSnapshot(acc accio.Access, data *ReveloData, ver string) (*ReveloData, error) {
+	if _, err := horcrux.VerNum(ver); err != nil {
+		return nil, fuse.ENOENT
+	}
+
+	data.snapLock.Lock()
+	defer data.snapLock.Unlock()
+
+	if snap, ok := data.snaps[ver]; ok {
+		return snap, nil
+	}
+
+	meta, err := versionMeta(acc, data, ver, data.key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fuse.ENOENT
+		}
+		return nil, fuse.EIO
+	}
+
+	if err := checkMeta(meta); err != nil {
+		return nil, fuse.EIO
+	}
+
+	if _, err := os.Stat(versionName(data.cacheDir, data.name, ver)); err != nil {
+		if err := verifyMeta(data, meta); err != nil {
+			return nil, fuse.EPERM
+		}
+	}
+
+	c, err := codec.New(meta.Config, data.key)
+	if err != nil {
+		log.WithFields(log.Fields{"Version": ver, "Error": err}).Error("Snapshot: Cannot init codec")
+		return nil, fuse.EIO
+	}
+
+	next := horcrux.SetInodes(meta, nil)
+	root, err := dirTree.Create(meta)
+	if err != nil {
+		log.WithFields(log.Fields{"Version": ver, "Error": err}).Error("Snapshot: Cannot create dirTree")
+		return nil, fuse.EIO
+	}
+
+	snap := &ReveloData{
+		Config:    meta.Config,
+		NumFiles:  meta.NumFiles,
+		CurrVer:   meta.CurrVer,
+		History:   meta.History,
+		name:      data.name,
+		metaName:  data.metaName,
+		Root:      root,
+		codec:     c,
+		acc:       acc,
+		key:       data.key,
+		verify:    data.verify,
+		trusted:   data.trusted,
+		remoteDir: data.remoteDir,
+		cacheDir:  data.cacheDir,
+		workDir:   data.cacheDir + "/" + CACHE_VERDIR + "/" + ver,
+		mntDir:    data.mntDir,
+		readOnly:  true,
+		pinned:    true,
+		snapshot:  true,
+		nextIno:   next,
+	}
+
+	setLinks(snap, root, meta)
+
+	if data.snaps == nil {
+		data.snaps = make(map[string]*ReveloData)
+	}
+	data.snaps[ver] = snap
+
+	log.WithFields(log.Fields{"Version": ver, "Files": meta.NumFiles}).Info("Snapshot: Loaded")
+	return snap, nil
+}
+
+// Snapshots are read only, whatever the mount is - and read only mounts
+// are read only to the kernel already
+func roCheck(data *ReveloData) error {
+	if data.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return nil
+}
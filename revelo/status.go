@@ -0,0 +1,240 @@
+//
+// Status - local changes of a mount, from its base version
+//  - Base is the meta of the version the working meta is from (CurrVer),
+//    kept as is in <name>.base.meta next to the working meta. Its saved
+//    when the working meta is got first, and on commit.
+//  - Files are matched by their path below the horcrux root
+//  - Changed chunks are found by hash - dirty chunks are hashed too, so
+//    data written back as it was, or committed, is not a change
+//
+
+package revelo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/revelo/dirTree"
+)
+
+// Change types
+const (
+	CHANGE_ADDED    = "added"
+	CHANGE_REMOVED  = "removed"
+	CHANGE_MODIFIED = "modified"
+)
+
+// Byte range of a file
+type Range struct {
+	Off int64 `json:"Offset"`
+	Len int64 `json:"Length"`
+}
+
+type Change struct {
+	Path   string        `json:"Path"` // Below the horcrux root
+	Type   string        `json:"Type"`
+	IsDir  bool          `json:"IsDir"`
+	Old    *horcrux.Stat `json:"Old Stat,omitempty"`       // Of removed or modified
+	New    *horcrux.Stat `json:"New Stat,omitempty"`       // Of added or modified
+	Ranges []Range       `json:"Changed Ranges,omitempty"` // Data changed, for files
+	Chunks int           `json:"Changed Chunks,omitempty"`
+	Bytes  int64         `json:"Changed Bytes,omitempty"`
+}
+
+// Local name of the base meta
+func baseName(data *ReveloData) string {
+	return data.workDir + "/" + data.name + ".base.meta"
+}
+
+// Saves Meta as the base meta
+func writeBase(data *ReveloData, Meta *horcrux.Meta) error {
+	name := baseName(data)
+
+	js, err := json.MarshalIndent(Meta, "", "    ")
+	if err != nil {
+		log.WithFields(log.Fields{"Version": Meta.CurrVer, "Error": err}).Error("Revelo: Cannot marshal base meta")
+		return err
+	}
+
+	if err := ioutil.WriteFile(name+".tmp", js, 0600); err != nil {
+		log.WithFields(log.Fields{"Meta File": name, "Error": err}).Error("Revelo: Cannot write base meta")
+		os.Remove(name + ".tmp")
+		return err
+	}
+
+	if err := os.Rename(name+".tmp", name); err != nil {
+		log.WithFields(log.Fields{"Meta File": name, "Error": err}).Error("Revelo: Cannot rename base meta")
+		os.Remove(name + ".tmp")
+		return err
+	}
+
+	return nil
+}
+
+// Changes in horcrux mounted at mntDir, from its base version
+func Status(mntDir string) ([]Change, error) {
+	data, err := getMount(mntDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return status(data)
+}
+
+func status(data *ReveloData) ([]Change, error) {
+	base, err := readMeta(baseName(data), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data.lock.RLock()
+	Meta, err := dirTree.GetMeta(data.Root)
+	data.lock.RUnlock()
+
+	if err != nil {
+		log.Error("Status: Cannot get Meta data")
+		return nil, err
+	}
+
+	return diffMeta(data.Config, base, Meta, func(entry *horcrux.Entry, idx int64) (string, error) {
+		buf, err := readDirtyChunk(data, entry, idx)
+		if err != nil {
+			return "", err
+		}
+		return data.codec.Hash(buf), nil
+	})
+}
+
+// Changes from base to Meta, sorted by path
+// dirtyHash gives the hash of chunks not in the chunk store ("" in Meta)
+func diffMeta(cfg horcrux.Config, base *horcrux.Meta, Meta *horcrux.Meta,
+	dirtyHash func(*horcrux.Entry, int64) (string, error)) ([]Change, error) {
+
+	baseEntries := make(map[string]*horcrux.Entry)
+	for i := range base.Entries {
+		// Entries[0] is the root
+		if i > 0 {
+			baseEntries[entryPath(&base.Entries[i])] = &base.Entries[i]
+		}
+	}
+
+	var changes []Change
+	seen := make(map[string]bool)
+	for i := 1; i < len(Meta.Entries); i++ {
+		entry := &Meta.Entries[i]
+		name := entryPath(entry)
+		seen[name] = true
+
+		old, ok := baseEntries[name]
+		if ok && old.IsDir != entry.IsDir {
+			changes = append(changes, removed(name, old))
+			ok = false
+		}
+
+		if !ok {
+			change := Change{Path: name, Type: CHANGE_ADDED, IsDir: entry.IsDir, New: &entry.Stat}
+			if !entry.IsDir && !entry.IsLink() && !entry.HardLink && entry.Stat.Size > 0 {
+				change.Ranges = []Range{{Off: 0, Len: entry.Stat.Size}}
+				change.Chunks = len(entry.Chunks)
+				change.Bytes = entry.Stat.Size
+			}
+			changes = append(changes, change)
+			continue
+		}
+
+		ranges, chunks, err := changedRanges(cfg, old, entry, dirtyHash)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ranges) > 0 || !sameStat(old, entry) {
+			change := Change{Path: name, Type: CHANGE_MODIFIED, IsDir: entry.IsDir, Old: &old.Stat, New: &entry.Stat,
+				Ranges: ranges, Chunks: chunks}
+			for _, rg := range ranges {
+				change.Bytes += rg.Len
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	for name, old := range baseEntries {
+		if !seen[name] {
+			changes = append(changes, removed(name, old))
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+func removed(name string, old *horcrux.Entry) Change {
+	change := Change{Path: name, Type: CHANGE_REMOVED, IsDir: old.IsDir, Old: &old.Stat}
+	if !old.IsDir && !old.IsLink() && !old.HardLink {
+		change.Chunks = len(old.Chunks)
+		change.Bytes = old.Stat.Size
+	}
+	return change
+}
+
+// Same size, mode, owner, symlink target and hard link - times are not compared
+func sameStat(old *horcrux.Entry, entry *horcrux.Entry) bool {
+	if old.Stat.Mode != entry.Stat.Mode || old.Stat.Uid != entry.Stat.Uid || old.Stat.Gid != entry.Stat.Gid ||
+		old.Target != entry.Target || old.HardLink != entry.HardLink {
+		return false
+	}
+	return entry.IsDir || old.Stat.Size == entry.Stat.Size
+}
+
+// File ranges of entry with data not in old, and the number of chunks in them
+//  - A chunk is in old if any of its chunks has the hash, so data
+//    shifted by an insert (rollsum) is not counted as changed
+func changedRanges(cfg horcrux.Config, old *horcrux.Entry, entry *horcrux.Entry,
+	dirtyHash func(*horcrux.Entry, int64) (string, error)) ([]Range, int, error) {
+
+	if entry.IsDir {
+		return nil, 0, nil
+	}
+
+	oldHashes := make(map[string]bool, len(old.Chunks))
+	for _, hash := range old.Chunks {
+		if hash != "" {
+			oldHashes[hash] = true
+		}
+	}
+
+	var ranges []Range
+	chunks := 0
+	for idx, hash := range entry.Chunks {
+		i := int64(idx)
+		off, n := chunkStart(cfg, entry, i), chunkLen(cfg, entry, i)
+		if n == 0 {
+			continue
+		}
+
+		if hash == "" {
+			var err error
+			if hash, err = dirtyHash(entry, i); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		if oldHashes[hash] {
+			continue
+		}
+		chunks++
+
+		// Merge with the previous one, if adjacent
+		if last := len(ranges) - 1; last >= 0 && ranges[last].Off+ranges[last].Len == off {
+			ranges[last].Len += n
+			continue
+		}
+		ranges = append(ranges, Range{Off: off, Len: n})
+	}
+
+	return ranges, chunks, nil
+}
@@ -0,0 +1,134 @@
+package revelo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/reducto"
+)
+
+// Root T with file T/a - 3 static chunks of 4 bytes, the last one short
+func statusMeta() *horcrux.Meta {
+	return &horcrux.Meta{
+		Entries: []horcrux.Entry{
+			{Name: "T", IsDir: true, Stat: horcrux.Stat{Mode: os.ModeDir | 0755}},
+			{Name: "a", Prefix: "T", Stat: horcrux.Stat{Mode: 0644, Size: 10}, NumChunks: 3,
+				ChunkOffs: []int64{0, 4, 8}, Chunks: []string{"h0", "h1", "h2"}},
+		},
+	}
+}
+
+var statusCfg = horcrux.Config{ChunkType: horcrux.CHUNK_TYPE_STATIC, ChunkSize: 4}
+
+// Dirty chunks hash to what they had in statusMeta
+func sameDirty(entry *horcrux.Entry, idx int64) (string, error) {
+	return fmt.Sprintf("h%d", idx), nil
+}
+
+func TestDiffMetaRanges(t *testing.T) {
+	M := statusMeta()
+	M.Entries[1].Chunks[0] = "x0"
+	M.Entries[1].Chunks[1] = "" // Dirty, same data
+	M.Entries[1].Chunks[2] = "x2"
+
+	changes, err := diffMeta(statusCfg, statusMeta(), M, sameDirty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Type != CHANGE_MODIFIED {
+		t.Fatalf("%+v", changes)
+	}
+	if got := fmt.Sprint(changes[0].Ranges); got != "[{0 4} {8 2}]" {
+		t.Errorf("ranges %v", got)
+	}
+	if changes[0].Chunks != 2 || changes[0].Bytes != 6 {
+		t.Errorf("%v chunks, %v bytes changed", changes[0].Chunks, changes[0].Bytes)
+	}
+
+	// Adjacent chunks are one range
+	M = statusMeta()
+	M.Entries[1].Chunks[1] = "x1"
+	M.Entries[1].Chunks[2] = "x2"
+	changes, _ = diffMeta(statusCfg, statusMeta(), M, sameDirty)
+	if got := fmt.Sprint(changes[0].Ranges); got != "[{4 6}]" {
+		t.Errorf("ranges %v", got)
+	}
+
+	// Only times changed
+	M = statusMeta()
+	M.Entries[1].Stat.Mtime = 100
+	if changes, _ = diffMeta(statusCfg, statusMeta(), M, sameDirty); len(changes) != 0 {
+		t.Errorf("%+v", changes)
+	}
+}
+
+func TestDiffMetaEntries(t *testing.T) {
+	M := statusMeta()
+	M.Entries[1].Name = "b"
+	M.Entries = append(M.Entries, horcrux.Entry{Name: "d", Prefix: "T", IsDir: true})
+
+	changes, err := diffMeta(statusCfg, statusMeta(), M, sameDirty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, ch := range changes {
+		got = append(got, fmt.Sprint(ch.Path, " ", ch.Type, " ", ch.Ranges, " ", ch.Chunks, " ", ch.Bytes))
+	}
+	if fmt.Sprint(got) != "[a removed [] 3 10 b added [{0 10}] 3 10 d added [] 0 0]" {
+		t.Errorf("%v", got)
+	}
+}
+
+// Insert in the middle of a rollsum file shifts the rest - only chunks
+// around the insert have new data
+func TestDiffMetaRollsumInsert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revelo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	os.Mkdir(dir+"/in", 0755)
+	if err := ioutil.WriteFile(dir+"/in/a", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reducto.Reducto(horcrux.CHUNK_TYPE_ROLLSUM, 4096, "", nil, nil, "", "T", dir+"/in", dir+"/out"); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := append(append(append([]byte(nil), data[:100<<10]...), "inserted"...), data[100<<10:]...)
+	if err := ioutil.WriteFile(dir+"/in/a", changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reducto.Update(nil, nil, "", "T", dir+"/in", dir+"/out"); err != nil {
+		t.Fatal(err)
+	}
+
+	v1, err := readMeta(dir+"/out/"+horcrux.VerMetaPath("v1", "T"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := readMeta(dir+"/out/"+horcrux.VerMetaPath("v2", "T"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := diffMeta(v2.Config, v1, v2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Type != CHANGE_MODIFIED {
+		t.Fatalf("%+v", changes)
+	}
+	if ch := changes[0]; ch.Chunks < 1 || ch.Chunks > 2 || ch.Bytes > 2*int64(v2.Config.MaxChunkSize) {
+		t.Errorf("%v of %v chunks, %v bytes changed", ch.Chunks, len(v2.Entries[1].Chunks), ch.Bytes)
+	}
+}
@@ -0,0 +1,83 @@
+//
+// Times of files and dirs - atime, mtime and ctime (Unix nsecs in
+// horcrux.Stat), from the source at generate
+//  - Writes set mtime and ctime of the file. They are saved with the meta
+//    on Flush (close) or Fsync, not on each write
+//  - Create, remove and rename set mtime and ctime of the dirs changed
+//  - Setattr sets atime and mtime as asked (touch), and ctime
+//  - Reads do not change atime, as noatime
+//  - Metas without atime or ctime show mtime for them
+//
+
+package revelo
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/muthu-r/horcrux"
+	"github.com/muthu-r/horcrux/bazil-fuse/fuse"
+	"github.com/muthu-r/horcrux/revelo/dirTree"
+)
+
+// Stat times for the kernel
+func statTimes(stat *horcrux.Stat, a *fuse.Attr) {
+	atime, ctime := stat.Atime, stat.Ctime
+	if atime == 0 {
+		atime = stat.Mtime
+	}
+	if ctime == 0 {
+		ctime = stat.Mtime
+	}
+
+	a.Atime = time.Unix(0, atime)
+	a.Mtime = time.Unix(0, stat.Mtime)
+	a.Ctime = time.Unix(0, ctime)
+}
+
+// File f was written - its mtime and ctime are now
+// Caller holds f.lock
+func touchFile(f *FILE) error {
+	now := time.Now().UnixNano()
+
+	newEntry := f.Entry
+	newEntry.Stat.Mtime = now
+	newEntry.Stat.Ctime = now
+	if err := updateMetaEntry(f.RData, f.Entry, newEntry); err != nil {
+		return err
+	}
+
+	f.Entry = newEntry
+	f.touched = true
+	return nil
+}
+
+// Saves the meta if f was written since it was saved
+// Caller holds f.lock
+func saveTimes(f *FILE) error {
+	if !f.touched {
+		return nil
+	}
+
+	f.touched = false
+	return saveMeta(f.RData)
+}
+
+// Dir (path as prefix of its kids) got or lost entries - its mtime and
+// ctime are now
+// Caller holds data.lock
+func touchDir(data *ReveloData, dir string, now int64) {
+	dirPrefix, dirName := "", data.Root.Entry.Name
+	if strings.Contains(dir, "/") {
+		dirPrefix, dirName = path.Dir(dir), path.Base(dir)
+	}
+
+	n, err := dirTree.Lookup(data.Root, dirPrefix, dirName)
+	if err != nil {
+		return
+	}
+
+	n.Entry.Stat.Mtime = now
+	n.Entry.Stat.Ctime = now
+}